@@ -0,0 +1,167 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mau.fi/util/jsontime"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+)
+
+// ErrReadOnlyChat is returned for Matrix messages in chats where the user isn't allowed to post.
+var ErrReadOnlyChat = bridgev2.WrapErrorInStatus(errors.New("you can't send messages in this chat")).
+	WithStatus(event.MessageStatusFail).
+	WithErrorReason(event.MessageStatusUnsupported).
+	WithErrorAsMessage().
+	WithIsCertain(true).
+	WithSendNotice(false)
+
+// ErrRepliesNotSupported is returned for Matrix replies and thread messages, as only the text of a message is sent
+// to the remote network.
+var ErrRepliesNotSupported = bridgev2.WrapErrorInStatus(errors.New("replies and threads aren't supported on this network")).
+	WithStatus(event.MessageStatusFail).
+	WithErrorReason(event.MessageStatusUnsupported).
+	WithErrorAsMessage().
+	WithIsCertain(true).
+	WithSendNotice(true)
+
+// GetCapabilities implements bridgev2.NetworkConnector.
+//
+// Every flag here must be backed by the matching interface on MyNetworkClient,
+// see capabilities_test.go.
+func (c *MyConnector) GetCapabilities() *bridgev2.NetworkGeneralCapabilities {
+	return &bridgev2.NetworkGeneralCapabilities{
+		DisappearingMessages: true,
+		// The simulated network never changes profiles, but a real remote doesn't push profile
+		// changes, so ghosts are refreshed whenever they send a message. Profile lookups are rate limited.
+		AggressiveUpdateInfo: !c.Config.IsSimulated(),
+		// Sending a message on the remote network marks the chat as read, and Matrix read receipts aren't bridged.
+		ImplicitReadReceipts: false,
+		// No outgoing message timeouts: the outbox retries for several minutes and reports
+		// progress with message statuses itself, so the bridge's timeouts would fire while it's still trying.
+		OutgoingMessageTimeouts: nil,
+		Provisioning: bridgev2.ProvisioningCapabilities{
+			ResolveIdentifier: bridgev2.ResolveIdentifierCapabilities{
+				CreateDM:       true,
+				LookupPhone:    true,
+				LookupEmail:    true,
+				LookupUsername: true,
+				ContactList:    true,
+				Search:         true,
+			},
+			GroupCreation: map[string]bridgev2.GroupTypeCapabilities{
+				groupTypeGroup: {
+					TypeDescription: "group chat",
+					Name:            bridgev2.GroupFieldCapability{Allowed: true, Required: true, MaxLength: groupNameMaxLength},
+					Topic:           bridgev2.GroupFieldCapability{Allowed: true, MaxLength: groupTopicMaxLength},
+					Avatar:          bridgev2.GroupFieldCapability{Allowed: true},
+					Participants: bridgev2.GroupFieldCapability{
+						Allowed:   true,
+						Required:  true,
+						MinLength: 1,
+						MaxLength: c.Config.Groups.MaxParticipants,
+					},
+				},
+			},
+		},
+	}
+}
+
+// capVersion must be bumped whenever the features returned by GetCapabilities change.
+// It's part of every capability ID and is reported through GetBridgeInfoVersion,
+// which makes the bridge resend the capabilities of all portals after an upgrade.
+const capVersion = 7
+
+// capID returns the versioned capability ID for a chat type and role. Clients cache
+// capabilities by ID, so every distinct set of features must have its own ID.
+func capID(chatType ChatType, role RemoteRole) string {
+	return fmt.Sprintf("org.example.simplenetwork.capabilities.v%d+%s+%s", capVersion, chatType, role)
+}
+
+// disappearingTimerCaps are the disappearing message timers that can be set from Matrix. The remote network
+// only has timers that start when a message is sent, and only offers a fixed list of them.
+var disappearingTimerCaps = &event.DisappearingTimerCapability{
+	Types: []event.DisappearingType{event.DisappearingTypeAfterSend},
+	Timers: []jsontime.Milliseconds{
+		jsontime.MS(time.Hour),
+		jsontime.MS(24 * time.Hour),
+		jsontime.MS(7 * 24 * time.Hour),
+		jsontime.MS(90 * 24 * time.Hour),
+	},
+}
+
+var formattingCaps = event.FormattingFeatureMap{
+	event.FmtBold:          event.CapLevelFullySupported,
+	event.FmtItalic:        event.CapLevelFullySupported,
+	event.FmtUnderline:     event.CapLevelFullySupported,
+	event.FmtStrikethrough: event.CapLevelFullySupported,
+	event.FmtInlineCode:    event.CapLevelFullySupported,
+	event.FmtCodeBlock:     event.CapLevelFullySupported,
+}
+
+// GetCapabilities returns the supported features for a chat, which depend on the chat type
+// and on the role of this login in the chat.
+func (nc *MyNetworkClient) GetCapabilities(ctx context.Context, portal *bridgev2.Portal) *event.RoomFeatures {
+	meta := portal.Metadata.(*PortalMetadata)
+	chatType := meta.GetChatType()
+	role := meta.RoleOf(nc.remoteUserID())
+
+	caps := &event.RoomFeatures{
+		ID:            capID(chatType, role),
+		MemberActions: memberActionCaps(chatType, role),
+		// The timer is always declared so that the bridge keeps its state event in the room, even for
+		// users who can't change it.
+		DisappearingTimer: disappearingTimerCaps,
+	}
+	caps.State = make(event.StateFeatureMap)
+	if chatType.CanEditInfo(role) {
+		caps.State[event.StateRoomName.Type] = &event.StateFeatures{Level: event.CapLevelFullySupported}
+		caps.State[event.StateTopic.Type] = &event.StateFeatures{Level: event.CapLevelFullySupported}
+		caps.State[event.StateRoomAvatar.Type] = &event.StateFeatures{Level: event.CapLevelFullySupported}
+	}
+	if chatType == ChatTypeDM || chatType.CanEditInfo(role) {
+		caps.State[event.StateBeeperDisappearingTimer.Type] = &event.StateFeatures{Level: event.CapLevelFullySupported}
+	}
+	if chatType.CanChangeRole(role, RoleMember, RoleModerator) {
+		// Promoting members to moderators is the least that admins can do.
+		caps.State[event.StatePowerLevels.Type] = &event.StateFeatures{Level: event.CapLevelFullySupported}
+	}
+	if !chatType.CanSend(role) {
+		// Read-only for this user: reject everything that would have to be sent to the remote.
+		caps.Reply = event.CapLevelRejected
+		caps.Thread = event.CapLevelRejected
+		caps.Edit = event.CapLevelRejected
+		return caps
+	}
+	caps.MaxTextLength = 65536
+	caps.Formatting = formattingCaps
+	// Only the text of a message is sent to the remote, so media, locations, replies and threads are rejected
+	// by HandleMatrixMessage. Media is rejected by the bridge already, as File is empty.
+	// Edits and read receipts aren't bridged to the remote either, the bridge rejects them without a handler.
+	caps.LocationMessage = event.CapLevelRejected
+	caps.Reply = event.CapLevelRejected
+	caps.Thread = event.CapLevelRejected
+	return caps
+}
+
+// memberActionCaps returns the Matrix membership changes that HandleMatrixMembership bridges for the role.
+func memberActionCaps(chatType ChatType, role RemoteRole) event.MemberFeatureMap {
+	if chatType == ChatTypeDM {
+		return nil
+	}
+	level := func(allowed bool) event.CapabilitySupportLevel {
+		if allowed {
+			return event.CapLevelFullySupported
+		}
+		return event.CapLevelRejected
+	}
+	return event.MemberFeatureMap{
+		event.MemberActionInvite: level(chatType.CanInvite(role)),
+		event.MemberActionKick:   level(chatType.CanManageMembers(role)),
+		event.MemberActionBan:    level(chatType.CanManageMembers(role)),
+		event.MemberActionLeave:  event.CapLevelFullySupported,
+	}
+}
@@ -0,0 +1,69 @@
+package connector
+
+import (
+	"context"
+	"testing"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+func TestGeneralCapabilitiesMatchClient(t *testing.T) {
+	var client bridgev2.NetworkAPI = &MyNetworkClient{}
+	for _, apiBaseURL := range []string{"", "https://remote.example.org/api"} {
+		connector := &MyConnector{Config: NetworkConfig{APIBaseURL: apiBaseURL}}
+		caps := connector.GetCapabilities()
+
+		_, disappearing := client.(bridgev2.DisappearTimerChangingNetworkAPI)
+		if caps.DisappearingMessages != disappearing {
+			t.Errorf("api_base_url=%q: DisappearingMessages is %t, but DisappearTimerChangingNetworkAPI implemented is %t",
+				apiBaseURL, caps.DisappearingMessages, disappearing)
+		}
+		_, readReceipts := client.(bridgev2.ReadReceiptHandlingNetworkAPI)
+		if caps.ImplicitReadReceipts && !readReceipts {
+			t.Errorf("api_base_url=%q: ImplicitReadReceipts is set, but ReadReceiptHandlingNetworkAPI isn't implemented", apiBaseURL)
+		}
+
+		resolve := caps.Provisioning.ResolveIdentifier
+		_, resolving := client.(bridgev2.IdentifierResolvingNetworkAPI)
+		if lookup := resolve.CreateDM || resolve.LookupPhone || resolve.LookupEmail || resolve.LookupUsername || resolve.AnyPhone; lookup != resolving {
+			t.Errorf("api_base_url=%q: identifier lookups declared is %t, but IdentifierResolvingNetworkAPI implemented is %t",
+				apiBaseURL, lookup, resolving)
+		}
+		_, contacts := client.(bridgev2.ContactListingNetworkAPI)
+		if resolve.ContactList != contacts {
+			t.Errorf("api_base_url=%q: ContactList is %t, but ContactListingNetworkAPI implemented is %t",
+				apiBaseURL, resolve.ContactList, contacts)
+		}
+		_, search := client.(bridgev2.UserSearchingNetworkAPI)
+		if resolve.Search != search {
+			t.Errorf("api_base_url=%q: Search is %t, but UserSearchingNetworkAPI implemented is %t",
+				apiBaseURL, resolve.Search, search)
+		}
+		_, groups := client.(bridgev2.GroupCreatingNetworkAPI)
+		if declared := len(caps.Provisioning.GroupCreation) > 0; declared != groups {
+			t.Errorf("api_base_url=%q: group creation declared is %t, but GroupCreatingNetworkAPI implemented is %t",
+				apiBaseURL, declared, groups)
+		}
+	}
+}
+
+func TestRoomCapabilitiesDependOnRole(t *testing.T) {
+	client := &MyNetworkClient{login: &bridgev2.UserLogin{UserLogin: &database.UserLogin{RemoteName: "me"}}}
+	portal := &bridgev2.Portal{Portal: &database.Portal{Metadata: &PortalMetadata{ChatType: ChatTypeChannel}}}
+
+	memberCaps := client.GetCapabilities(context.Background(), portal)
+	if !memberCaps.Edit.Reject() || memberCaps.MaxTextLength != 0 {
+		t.Errorf("channel members shouldn't be able to send, got edit=%d max_text_length=%d", memberCaps.Edit, memberCaps.MaxTextLength)
+	}
+
+	portal.Metadata.(*PortalMetadata).Roles = map[networkid.UserID]RemoteRole{"me": RoleAdmin}
+	adminCaps := client.GetCapabilities(context.Background(), portal)
+	if adminCaps.Edit.Reject() || adminCaps.MaxTextLength == 0 {
+		t.Errorf("channel admins should be able to send, got edit=%d max_text_length=%d", adminCaps.Edit, adminCaps.MaxTextLength)
+	}
+	if memberCaps.GetID() == adminCaps.GetID() {
+		t.Errorf("member and admin capabilities have the same ID %q", memberCaps.GetID())
+	}
+}
@@ -0,0 +1,117 @@
+package connector
+
+import (
+	"context"
+	"maps"
+	"strings"
+
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+)
+
+// chatInfoFromNetworkChat converts a remote chat into the info used to create or update its portal.
+func (nc *MyNetworkClient) chatInfoFromNetworkChat(ctx context.Context, chat *NetworkChat) *bridgev2.ChatInfo {
+	info := &bridgev2.ChatInfo{
+		Members: &bridgev2.ChatMemberList{
+			IsFull:    true,
+			MemberMap: make(bridgev2.ChatMemberMap, len(chat.Members)),
+		},
+		CanBackfill: true,
+	}
+	roles := make(map[networkid.UserID]RemoteRole)
+	var otherUserID networkid.UserID
+	powerLevels := &nc.connector.Config.PowerLevels
+	for _, member := range chat.Members {
+		chatMember := bridgev2.ChatMember{
+			EventSender: nc.makeEventSender(ctx, member.UserID),
+			Membership:  event.MembershipJoin,
+		}
+		if chat.Type != ChatTypeDM {
+			chatMember.PowerLevel = ptr.Ptr(powerLevels.ForRole(member.Role))
+		}
+		info.Members.MemberMap[member.UserID] = chatMember
+		if member.Role != "" && member.Role != RoleMember {
+			roles[NormalizeRemoteUserID(string(member.UserID))] = member.Role
+		}
+		if !nc.IsThisUser(ctx, member.UserID) {
+			otherUserID = member.UserID
+		}
+	}
+	if chat.Type == ChatTypeDM {
+		// DM names and avatars come from the other user's ghost.
+		info.Type = ptr.Ptr(database.RoomTypeDM)
+		info.Members.OtherUserID = otherUserID
+	} else {
+		info.Type = ptr.Ptr(database.RoomTypeDefault)
+		info.Name = ptr.Ptr(chat.Name)
+		info.Topic = ptr.Ptr(chat.Topic)
+		info.Avatar = nc.makeAvatar(chat.AvatarURL)
+		info.Members.PowerLevels = powerLevels.overrides(chat.Type)
+		otherUserID = ""
+	}
+	info.Disappear = ptr.Ptr(disappearingSetting(chat.DisappearTimer))
+	info.ExtraUpdates = updatePortalMetadata(chat.Type, otherUserID, roles)
+	if chat.Type != ChatTypeDM {
+		info.ExtraUpdates = bridgev2.MergeExtraUpdaters(info.ExtraUpdates, updatePortalNameAndTopic(info.Name, info.Topic))
+	}
+	return info
+}
+
+// updatePortalMetadata returns an updater that stores the chat type and roles in the portal metadata.
+func updatePortalMetadata(chatType ChatType, otherUserID networkid.UserID, roles map[networkid.UserID]RemoteRole) bridgev2.ExtraUpdater[*bridgev2.Portal] {
+	return func(ctx context.Context, portal *bridgev2.Portal) bool {
+		meta := portal.Metadata.(*PortalMetadata)
+		if meta.ChatType == chatType && meta.OtherUserID == otherUserID && maps.Equal(meta.Roles, roles) {
+			return false
+		}
+		meta.ChatType = chatType
+		meta.OtherUserID = otherUserID
+		meta.Roles = roles
+		return true
+	}
+}
+
+// setPortalRole returns an updater that stores the role of a user in the portal metadata.
+// RoleMember is the default, so it removes the user from the roles map.
+func setPortalRole(userID networkid.UserID, role RemoteRole) bridgev2.ExtraUpdater[*bridgev2.Portal] {
+	return func(ctx context.Context, portal *bridgev2.Portal) bool {
+		meta := portal.Metadata.(*PortalMetadata)
+		if meta.RoleOf(userID) == role {
+			return false
+		}
+		// Older portals may have the user stored in a different case, which RoleOf would still find.
+		for otherID := range meta.Roles {
+			if strings.EqualFold(string(otherID), string(userID)) {
+				delete(meta.Roles, otherID)
+			}
+		}
+		if role != RoleMember {
+			if meta.Roles == nil {
+				meta.Roles = make(map[networkid.UserID]RemoteRole)
+			}
+			meta.Roles[NormalizeRemoteUserID(string(userID))] = role
+		}
+		return true
+	}
+}
+
+// updatePortalNameAndTopic returns an updater that stores the remote name and topic of the chat in the portal metadata.
+// Nil values are left unchanged.
+func updatePortalNameAndTopic(name, topic *string) bridgev2.ExtraUpdater[*bridgev2.Portal] {
+	return func(ctx context.Context, portal *bridgev2.Portal) bool {
+		meta := portal.Metadata.(*PortalMetadata)
+		changed := false
+		if name != nil && meta.InitialName != *name {
+			meta.InitialName = *name
+			changed = true
+		}
+		if topic != nil && meta.RemoteTopic != *topic {
+			meta.RemoteTopic = *topic
+			changed = true
+		}
+		return changed
+	}
+}
@@ -0,0 +1,64 @@
+package connector
+
+import (
+	"context"
+	"maps"
+	"testing"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+func TestSetPortalRole(t *testing.T) {
+	tests := []struct {
+		name      string
+		roles     map[networkid.UserID]RemoteRole
+		userID    networkid.UserID
+		role      RemoteRole
+		wantRoles map[networkid.UserID]RemoteRole
+		changed   bool
+	}{{
+		name:      "new role is stored normalized",
+		userID:    "Alice",
+		role:      RoleAdmin,
+		wantRoles: map[networkid.UserID]RemoteRole{"alice": RoleAdmin},
+		changed:   true,
+	}, {
+		name:      "same role in a different case is unchanged",
+		roles:     map[networkid.UserID]RemoteRole{"alice": RoleAdmin},
+		userID:    "ALICE",
+		role:      RoleAdmin,
+		wantRoles: map[networkid.UserID]RemoteRole{"alice": RoleAdmin},
+	}, {
+		name:      "demoting removes a role stored in a different case",
+		roles:     map[networkid.UserID]RemoteRole{"Alice": RoleAdmin, "bob": RoleOwner},
+		userID:    "alice",
+		role:      RoleMember,
+		wantRoles: map[networkid.UserID]RemoteRole{"bob": RoleOwner},
+		changed:   true,
+	}, {
+		name:      "changing a role replaces the old key",
+		roles:     map[networkid.UserID]RemoteRole{"ALICE": RoleAdmin},
+		userID:    "Alice",
+		role:      RoleOwner,
+		wantRoles: map[networkid.UserID]RemoteRole{"alice": RoleOwner},
+		changed:   true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			meta := &PortalMetadata{Roles: test.roles}
+			portal := &bridgev2.Portal{Portal: &database.Portal{Metadata: meta}}
+			changed := setPortalRole(test.userID, test.role)(context.Background(), portal)
+			if changed != test.changed {
+				t.Errorf("expected changed to be %t, got %t", test.changed, changed)
+			}
+			if !maps.Equal(meta.Roles, test.wantRoles) {
+				t.Errorf("expected roles %v, got %v", test.wantRoles, meta.Roles)
+			}
+			if role := meta.RoleOf(test.userID); role != test.role {
+				t.Errorf("RoleOf(%q) is %q after setting %q", test.userID, role, test.role)
+			}
+		})
+	}
+}
@@ -0,0 +1,393 @@
+package connector
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/commands"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+	"maunium.net/go/mautrix/id"
+)
+
+// HelpSectionSimpleNetwork contains the commands added by this connector.
+var HelpSectionSimpleNetwork = commands.HelpSection{Name: "Simple network", Order: 60}
+
+// maxBackfillCount is the largest number of messages that can be requested with the backfill command.
+const maxBackfillCount = 1000
+
+var cmdSyncChats = &commands.FullHandler{
+	Func: fnSyncChats,
+	Name: "sync-chats",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionSimpleNetwork,
+		Description: "Sync your recent chats from the remote network and create portals for them",
+		Args:        "[_account_]",
+	},
+	RequiresLogin: true,
+}
+
+var cmdResync = &commands.FullHandler{
+	Func: fnResync,
+	Name: "resync",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionSimpleNetwork,
+		Description: "Fetch the name, topic, avatar and members of a chat from the remote network again",
+		Args:        "[_room ID or chat ID_]",
+	},
+	RequiresLogin: true,
+}
+
+var cmdBackfill = &commands.FullHandler{
+	Func: fnBackfill,
+	Name: "backfill",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionSimpleNetwork,
+		Description: "Fetch up to _count_ recent messages that are missing from a portal",
+		Args:        "[_room ID or chat ID_] <_count_>",
+	},
+	RequiresAdmin: true,
+	RequiresLogin: true,
+}
+
+var cmdPingRemote = &commands.FullHandler{
+	Func:    fnPingRemote,
+	Name:    "ping-remote",
+	Aliases: []string{"ping-network"},
+	Help: commands.HelpMeta{
+		Section:     HelpSectionSimpleNetwork,
+		Description: "Check that the remote network answers requests and measure how long it takes",
+		Args:        "[_account_]",
+	},
+	RequiresLogin: true,
+}
+
+var cmdWhoami = &commands.FullHandler{
+	Func: fnWhoami,
+	Name: "whoami",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionSimpleNetwork,
+		Description: "Show your remote accounts and their connection status",
+	},
+	RequiresLogin: true,
+}
+
+// cmdStartChat and cmdResolveIdentifier replace the built-in commands, which only take login IDs to pick the login.
+// These also take remote usernames, and ask users with several logins which one to use instead of picking one.
+var cmdStartChat = &commands.FullHandler{
+	Func:    fnResolveIdentifier,
+	Name:    commands.CommandStartChat.Name,
+	Aliases: commands.CommandStartChat.Aliases,
+	Help: commands.HelpMeta{
+		Section:     commands.CommandStartChat.Help.Section,
+		Description: commands.CommandStartChat.Help.Description,
+		Args:        "[_account_] <_identifier_>",
+	},
+	RequiresLogin: true,
+	NetworkAPI:    commands.CommandStartChat.NetworkAPI,
+}
+
+var cmdResolveIdentifier = &commands.FullHandler{
+	Func: fnResolveIdentifier,
+	Name: commands.CommandResolveIdentifier.Name,
+	Help: commands.HelpMeta{
+		Section:     commands.CommandResolveIdentifier.Help.Section,
+		Description: commands.CommandResolveIdentifier.Help.Description,
+		Args:        "[_account_] <_identifier_>",
+	},
+	RequiresLogin: true,
+	NetworkAPI:    commands.CommandResolveIdentifier.NetworkAPI,
+}
+
+// cmdSetRelay replaces the built-in set-relay command. The system portal and DMs only have the user and a
+// single remote user in them, so a relay would never be used there.
+var cmdSetRelay = &commands.FullHandler{
+	Func:           fnSetRelay,
+	Name:           commands.CommandSetRelay.Name,
+	Help:           commands.CommandSetRelay.Help,
+	RequiresPortal: true,
+}
+
+// registerCommands adds the connector's commands to the bridge command processor.
+func (c *MyConnector) registerCommands() {
+	proc, ok := c.bridge.Commands.(*commands.Processor)
+	if !ok {
+		c.log.Warn().Type("processor_type", c.bridge.Commands).Msg("Unknown command processor, not registering connector commands")
+		return
+	}
+	proc.AddHandlers(cmdSyncChats, cmdResync, cmdBackfill, cmdPingRemote, cmdWhoami, cmdStartChat, cmdResolveIdentifier, cmdSetRelay)
+}
+
+// getCommandClient picks the login that a command is run with. Users with several logins choose one by passing its
+// remote username or login ID as the first argument, if there are more than minArgs arguments. Without one, the login
+// in the current portal is used, and the user is asked to pick one if that doesn't work either.
+// The arguments after the login are returned.
+func getCommandClient(ce *commands.Event, minArgs int) (*MyNetworkClient, []string) {
+	logins := ce.User.GetUserLogins()
+	args := ce.Args
+	var login *bridgev2.UserLogin
+	if len(args) > minArgs {
+		login = findUserLogin(logins, args[0])
+		if login != nil {
+			args = args[1:]
+		}
+	}
+	if login == nil && len(logins) == 1 {
+		login = logins[0]
+	} else if login == nil && ce.Portal != nil {
+		var err error
+		login, _, err = ce.Portal.FindPreferredLogin(ce.Ctx, ce.User, false)
+		if err != nil {
+			ce.Log.Err(err).Msg("Failed to find login in portal")
+		}
+	}
+	if len(logins) == 0 {
+		ce.Reply("That command requires you to be logged in.")
+		return nil, nil
+	} else if login == nil {
+		ce.Reply("%s", formatLoginPicker(ce, logins))
+		return nil, nil
+	}
+	nc, ok := login.Client.(*MyNetworkClient)
+	if !ok {
+		ce.Reply("Your login **%s** isn't loaded, try again in a moment.", login.RemoteName)
+		return nil, nil
+	}
+	return nc, args
+}
+
+// findUserLogin returns the login whose login ID or remote username is the given account.
+func findUserLogin(logins []*bridgev2.UserLogin, account string) *bridgev2.UserLogin {
+	for _, login := range logins {
+		if string(login.ID) == account || strings.EqualFold(login.RemoteName, account) {
+			return login
+		}
+	}
+	return nil
+}
+
+// formatLoginPicker asks users with several logins to choose one for a command.
+func formatLoginPicker(ce *commands.Event, logins []*bridgev2.UserLogin) string {
+	var buf strings.Builder
+	_, _ = fmt.Fprintf(&buf, "You're logged in with several accounts. Choose one by putting its username before the arguments, "+
+		"like `%s`:\n\n", strings.TrimSpace(strings.Join([]string{ce.Bridge.Config.CommandPrefix, ce.Command, logins[0].RemoteName, ce.RawArgs}, " ")))
+	for _, login := range logins {
+		_, _ = fmt.Fprintf(&buf, "* **%s**\n", login.RemoteName)
+	}
+	return buf.String()
+}
+
+// getCommandPortal finds the portal that a command refers to and the login to use with it. The first argument is
+// used if it's a Matrix room ID or a remote chat ID, otherwise the command must be sent in a portal.
+// The remaining arguments are returned.
+func getCommandPortal(ce *commands.Event) (*bridgev2.Portal, *MyNetworkClient, []string) {
+	args := ce.Args
+	var portal *bridgev2.Portal
+	var err error
+	if len(args) > 0 && strings.HasPrefix(args[0], "!") {
+		portal, err = ce.Bridge.GetPortalByMXID(ce.Ctx, id.RoomID(args[0]))
+		args = args[1:]
+	} else if len(args) > 0 && (ce.Portal == nil || len(args) > 1) {
+		portal, err = findChatPortal(ce, networkid.PortalID(args[0]))
+		args = args[1:]
+	} else {
+		portal = ce.Portal
+	}
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to get portal for command")
+		ce.Reply("Failed to get portal: %v", err)
+		return nil, nil, nil
+	} else if portal == nil {
+		ce.Reply("Portal not found. Run the command in a portal room or pass a room ID or chat ID.")
+		return nil, nil, nil
+	}
+	// Split portals belong to their receiver, other portals are used with the user's login in the chat.
+	var login *bridgev2.UserLogin
+	if portal.Receiver != "" {
+		login = ce.Bridge.GetCachedUserLoginByID(portal.Receiver)
+	} else {
+		login, _, err = portal.FindPreferredLogin(ce.Ctx, ce.User, false)
+		if err != nil {
+			ce.Log.Err(err).Msg("Failed to find login in portal")
+		}
+	}
+	if login == nil || login.UserMXID != ce.User.MXID {
+		ce.Reply("None of your accounts are in %s.", formatPortal(portal))
+		return nil, nil, nil
+	}
+	nc, ok := login.Client.(*MyNetworkClient)
+	if !ok {
+		ce.Reply("Your login **%s** isn't loaded, try again in a moment.", login.RemoteName)
+		return nil, nil, nil
+	} else if nc.isSystemPortal(portal) {
+		ce.Reply("That command can't be used with %s.", formatPortal(portal))
+		return nil, nil, nil
+	}
+	return portal, nc, args
+}
+
+// findChatPortal returns the portal of a remote chat. With split portals, the portal of the first of the user's
+// logins that has one is returned.
+func findChatPortal(ce *commands.Event, chatID networkid.PortalID) (*bridgev2.Portal, error) {
+	if !ce.Bridge.Config.SplitPortals {
+		return ce.Bridge.GetExistingPortalByKey(ce.Ctx, networkid.PortalKey{ID: chatID})
+	}
+	for _, login := range ce.User.GetUserLogins() {
+		portal, err := ce.Bridge.GetExistingPortalByKey(ce.Ctx, networkid.PortalKey{ID: chatID, Receiver: login.ID})
+		if err != nil || portal != nil {
+			return portal, err
+		}
+	}
+	return nil, nil
+}
+
+// formatPortal returns a Markdown link to the room of a portal.
+func formatPortal(portal *bridgev2.Portal) string {
+	name := portal.Name
+	if name == "" {
+		name = string(portal.ID)
+	}
+	if portal.MXID == "" {
+		return fmt.Sprintf("%s (no Matrix room)", name)
+	}
+	return fmt.Sprintf("[%s](%s)", name, portal.MXID.URI().MatrixToURL())
+}
+
+func fnSyncChats(ce *commands.Event) {
+	nc, _ := getCommandClient(ce, 0)
+	if nc == nil {
+		return
+	}
+	count, err := nc.syncChats(ce.Ctx)
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to sync chats")
+		ce.Reply("Failed to sync chats: %v", err)
+		return
+	}
+	ce.Reply("Queued a sync of **%d** chats. Portals for new chats will be created in the background.", count)
+}
+
+func fnResync(ce *commands.Event) {
+	portal, nc, _ := getCommandPortal(ce)
+	if portal == nil {
+		return
+	}
+	// The remote API has no endpoint for a single chat, so the chat is picked from the full chat list.
+	chats, err := nc.remote.GetChats(ce.Ctx, 0)
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to get chats for resync")
+		ce.Reply("Failed to get chats from the remote network: %v", err)
+		return
+	}
+	for _, chat := range chats {
+		if chat.ID != portal.ID {
+			continue
+		}
+		nc.queueRemoteEvent(ce.Ctx, &simplevent.ChatResync{
+			EventMeta: simplevent.EventMeta{
+				Type:         bridgev2.RemoteEventChatResync,
+				PortalKey:    portal.PortalKey,
+				CreatePortal: true,
+			},
+			ChatInfo: nc.chatInfoFromNetworkChat(ce.Ctx, chat),
+		})
+		ce.Reply("Queued a resync of %s.", formatPortal(portal))
+		return
+	}
+	ce.Reply("%s isn't one of your chats on the remote network.", formatPortal(portal))
+}
+
+func fnBackfill(ce *commands.Event) {
+	if !ce.Bridge.Config.Backfill.Enabled || ce.Bridge.Config.Backfill.MaxCatchupMessages <= 0 {
+		ce.Reply("Backfilling is disabled in the bridge config.")
+		return
+	}
+	portal, nc, args := getCommandPortal(ce)
+	if portal == nil {
+		return
+	} else if len(args) != 1 {
+		ce.Reply("**Usage:** `$cmdprefix backfill [room ID or chat ID] <count>`")
+		return
+	}
+	count, err := strconv.Atoi(args[0])
+	if err != nil || count < 1 || count > maxBackfillCount {
+		ce.Reply("The count must be a number between 1 and %d.", maxBackfillCount)
+		return
+	} else if portal.MXID == "" {
+		ce.Reply("%s doesn't have a Matrix room yet, use `$cmdprefix resync` to create it.", formatPortal(portal))
+		return
+	}
+	// The bridge only backfills forward from a resync, so the count is passed to FetchMessages as bundled data.
+	nc.queueRemoteEvent(ce.Ctx, &simplevent.ChatResync{
+		EventMeta: simplevent.EventMeta{
+			Type:      bridgev2.RemoteEventChatResync,
+			PortalKey: portal.PortalKey,
+		},
+		CheckNeedsBackfillFunc: alwaysBackfill,
+		BundledBackfillData:    backfillCount(count),
+	})
+	ce.Reply("Queued a backfill of up to **%d** messages in %s. Messages that are already in the room are skipped.", count, formatPortal(portal))
+}
+
+func fnPingRemote(ce *commands.Event) {
+	nc, _ := getCommandClient(ce, 0)
+	if nc == nil {
+		return
+	}
+	start := time.Now()
+	user, err := nc.remote.GetUser(ce.Ctx, nc.remoteUserID())
+	took := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to ping remote network")
+		ce.Reply("The remote network didn't answer after %s: %v", took, err)
+		return
+	} else if user == nil {
+		ce.Reply("The remote network answered in %s, but it doesn't know **%s**.", took, nc.login.RemoteName)
+		return
+	}
+	ce.Reply("The remote network answered in %s.", took)
+}
+
+func fnWhoami(ce *commands.Event) {
+	var buf strings.Builder
+	_, _ = fmt.Fprintf(&buf, "You're logged in as %s with these remote accounts:\n\n", ce.User.MXID.URI().MatrixToURL())
+	for _, login := range ce.User.GetUserLogins() {
+		state := login.BridgeState.GetPrev().StateEvent
+		if state == "" {
+			state = "UNKNOWN"
+		}
+		_, _ = fmt.Fprintf(&buf, "* **%s** (`%s`) - %s", login.RemoteName, login.ID, state)
+		if login.SpaceRoom != "" {
+			_, _ = fmt.Fprintf(&buf, ", [space](%s)", login.SpaceRoom.URI().MatrixToURL())
+		}
+		buf.WriteString("\n")
+	}
+	ce.Reply("%s", buf.String())
+}
+
+func fnResolveIdentifier(ce *commands.Event) {
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage:** `$cmdprefix %s [account] <identifier>`", ce.Command)
+		return
+	}
+	nc, args := getCommandClient(ce, 1)
+	if nc == nil {
+		return
+	}
+	// The built-in command takes the login ID as the first argument.
+	ce.Args = append([]string{string(nc.login.ID)}, args...)
+	ce.RawArgs = strings.Join(ce.Args, " ")
+	commands.CommandStartChat.Func(ce)
+}
+
+func fnSetRelay(ce *commands.Event) {
+	if ce.Portal.RoomType == database.RoomTypeDM || ce.Portal.ID == MakeWelcomePortalID(ce.Portal.Receiver) {
+		ce.Reply("Relaying isn't needed in this room, as nobody else can send messages here.")
+		return
+	}
+	commands.CommandSetRelay.Func(ce)
+}
@@ -0,0 +1,401 @@
+package connector
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	up "go.mau.fi/util/configupgrade"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+)
+
+// ExampleConfig is the network section of the example config, also used as the base for config upgrades.
+//
+//go:embed example-config.yaml
+var ExampleConfig string
+
+// NetworkConfig contains the network-specific options from the `network` section of the bridge config.
+type NetworkConfig struct {
+	APIBaseURL     string        `yaml:"api_base_url"`
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+
+	Sync       SyncConfig      `yaml:"sync"`
+	RateLimits RateLimitConfig `yaml:"rate_limits"`
+	Groups     GroupConfig     `yaml:"groups"`
+
+	PowerLevels PowerLevelConfig `yaml:"power_levels"`
+	Onboarding  OnboardingConfig `yaml:"onboarding"`
+	Presence    PresenceConfig   `yaml:"presence"`
+
+	DisplaynameTemplate string `yaml:"displayname_template"`
+	ContactNamesInDMs   bool   `yaml:"contact_names_in_dms"`
+
+	displaynameTemplate *template.Template
+}
+
+// SyncConfig contains limits for syncing chats and history from the remote network.
+type SyncConfig struct {
+	ChatLimit         int           `yaml:"chat_limit"`
+	BackfillBatchSize int           `yaml:"backfill_batch_size"`
+	PollInterval      time.Duration `yaml:"poll_interval"`
+}
+
+// GroupConfig contains limits for creating remote groups from Matrix.
+type GroupConfig struct {
+	MaxParticipants int `yaml:"max_participants"`
+}
+
+// PresenceConfig contains the options for bridging online status.
+type PresenceConfig struct {
+	Receive     bool          `yaml:"receive"`
+	Send        bool          `yaml:"send"`
+	MinInterval time.Duration `yaml:"min_interval"`
+}
+
+// PowerLevelConfig maps remote roles to Matrix power levels. The levels must be in the same order as the roles,
+// so that a power level set in Matrix can be mapped back to a role.
+type PowerLevelConfig struct {
+	Owner      int `yaml:"owner"`
+	Admin      int `yaml:"admin"`
+	Moderator  int `yaml:"moderator"`
+	Member     int `yaml:"member"`
+	Restricted int `yaml:"restricted"`
+}
+
+// ForRole returns the power level of the given role.
+func (plc *PowerLevelConfig) ForRole(role RemoteRole) int {
+	switch role {
+	case RoleOwner:
+		return plc.Owner
+	case RoleAdmin:
+		return plc.Admin
+	case RoleModerator:
+		return plc.Moderator
+	case RoleRestricted:
+		return plc.Restricted
+	default:
+		return plc.Member
+	}
+}
+
+// RoleFor returns the highest role whose power level is at most the given level.
+// Levels below the restricted level map to the restricted role.
+func (plc *PowerLevelConfig) RoleFor(level int) RemoteRole {
+	switch {
+	case level >= plc.Owner:
+		return RoleOwner
+	case level >= plc.Admin:
+		return RoleAdmin
+	case level >= plc.Moderator:
+		return RoleModerator
+	case level >= plc.Member:
+		return RoleMember
+	default:
+		return RoleRestricted
+	}
+}
+
+// overrides returns the power levels required for actions in a chat of the given type,
+// matching the permissions of the remote roles.
+func (plc *PowerLevelConfig) overrides(chatType ChatType) *bridgev2.PowerLevelOverrides {
+	infoLevel := plc.Member
+	sendLevel := plc.Member
+	switch chatType {
+	case ChatTypeChannel:
+		infoLevel = plc.Admin
+		sendLevel = plc.Admin
+	case ChatTypeAnnouncement:
+		// Nobody can post or change anything in announcement chats.
+		infoLevel = plc.Owner + 1
+		sendLevel = plc.Owner + 1
+	}
+	return &bridgev2.PowerLevelOverrides{
+		UsersDefault:  ptr.Ptr(plc.Member),
+		EventsDefault: ptr.Ptr(sendLevel),
+		Invite:        ptr.Ptr(infoLevel),
+		Kick:          ptr.Ptr(plc.Moderator),
+		Ban:           ptr.Ptr(plc.Moderator),
+		Events: map[event.Type]int{
+			event.StateRoomName:    infoLevel,
+			event.StateTopic:       infoLevel,
+			event.StateRoomAvatar:  infoLevel,
+			event.StatePowerLevels: plc.Admin,
+		},
+	}
+}
+
+func (plc *PowerLevelConfig) validate() error {
+	if plc.Owner <= plc.Admin || plc.Admin <= plc.Moderator || plc.Moderator <= plc.Member || plc.Member <= plc.Restricted {
+		return errors.New("invalid value for network.power_levels: levels must be strictly decreasing from owner to restricted")
+	}
+	return nil
+}
+
+// OnboardingConfig configures the welcome room that is created once for every new login.
+// The text fields are templates that get OnboardingParams.
+type OnboardingConfig struct {
+	Enabled   bool   `yaml:"enabled"`
+	RoomName  string `yaml:"room_name"`
+	RoomTopic string `yaml:"room_topic"`
+	Greeting  string `yaml:"greeting"`
+	Help      string `yaml:"help"`
+
+	templates map[string]*template.Template
+}
+
+// OnboardingParams contains the variables available in the onboarding templates.
+type OnboardingParams struct {
+	RemoteName    string
+	BotName       string
+	NetworkName   string
+	CommandPrefix string
+}
+
+func (oc *OnboardingConfig) rawTemplate(name string) string {
+	switch name {
+	case "room_name":
+		return oc.RoomName
+	case "room_topic":
+		return oc.RoomTopic
+	case "greeting":
+		return oc.Greeting
+	case "help":
+		return oc.Help
+	default:
+		panic(fmt.Errorf("unknown onboarding template %q", name))
+	}
+}
+
+// compile parses the templates so that Format doesn't have to parse them again.
+func (oc *OnboardingConfig) compile() []error {
+	var errs []error
+	oc.templates = make(map[string]*template.Template, 4)
+	for _, name := range []string{"room_name", "room_topic", "greeting", "help"} {
+		tpl, err := template.New(name).Parse(oc.rawTemplate(name))
+		if err == nil {
+			err = tpl.Execute(io.Discard, &OnboardingParams{})
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid value for network.onboarding.%s: %w", name, err))
+			continue
+		}
+		oc.templates[name] = tpl
+	}
+	return errs
+}
+
+// Format renders the onboarding template with the given config key, e.g. "greeting".
+func (oc *OnboardingConfig) Format(name string, params *OnboardingParams) (string, error) {
+	tpl, ok := oc.templates[name]
+	if !ok {
+		// The config wasn't validated (e.g. the connector is used without mxmain), so parse it here.
+		var err error
+		tpl, err = template.New(name).Parse(oc.rawTemplate(name))
+		if err != nil {
+			return "", fmt.Errorf("failed to parse %s template: %w", name, err)
+		}
+	}
+	var buf strings.Builder
+	err := tpl.Execute(&buf, params)
+	if err != nil {
+		return "", fmt.Errorf("failed to render %s template: %w", name, err)
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// RateLimitConfig contains the client-side rate limits for calls to the remote API, per action class.
+type RateLimitConfig struct {
+	Send    RateLimit `yaml:"send"`
+	History RateLimit `yaml:"history"`
+	Profile RateLimit `yaml:"profile"`
+	Media   RateLimit `yaml:"media"`
+}
+
+// RateLimit configures a token bucket. A PerSecond of 0 disables the limit.
+type RateLimit struct {
+	PerSecond float64 `yaml:"per_second"`
+	Burst     int     `yaml:"burst"`
+}
+
+func (rl RateLimit) validate(name string) []error {
+	var errs []error
+	if rl.PerSecond < 0 {
+		errs = append(errs, fmt.Errorf("invalid value for network.rate_limits.%s.per_second: must not be negative", name))
+	}
+	if rl.PerSecond > 0 && rl.Burst < 1 {
+		errs = append(errs, fmt.Errorf("invalid value for network.rate_limits.%s.burst: must be at least 1", name))
+	}
+	return errs
+}
+
+// IsSimulated returns true if no remote API is configured and the built-in simulated network should be used.
+func (nc *NetworkConfig) IsSimulated() bool {
+	return nc.APIBaseURL == ""
+}
+
+// validate checks the config for invalid values and compiles the templates.
+// All problems are returned together so that they can be fixed in one go.
+func (nc *NetworkConfig) validate() error {
+	var errs []error
+	if nc.APIBaseURL != "" {
+		parsed, err := url.Parse(nc.APIBaseURL)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid value for network.api_base_url: %w", err))
+		} else if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			errs = append(errs, fmt.Errorf("invalid value for network.api_base_url: scheme must be http or https, got %q", parsed.Scheme))
+		} else if parsed.Host == "" {
+			errs = append(errs, errors.New("invalid value for network.api_base_url: host is missing"))
+		} else if parsed.RawQuery != "" || parsed.Fragment != "" {
+			errs = append(errs, errors.New("invalid value for network.api_base_url: must not contain a query or fragment"))
+		}
+	}
+	if nc.RequestTimeout <= 0 {
+		errs = append(errs, errors.New("invalid value for network.request_timeout: must be positive"))
+	}
+	if nc.ConnectTimeout <= 0 {
+		errs = append(errs, errors.New("invalid value for network.connect_timeout: must be positive"))
+	}
+	if nc.Sync.ChatLimit < 0 {
+		errs = append(errs, errors.New("invalid value for network.sync.chat_limit: must not be negative"))
+	}
+	if nc.Sync.BackfillBatchSize <= 0 {
+		errs = append(errs, errors.New("invalid value for network.sync.backfill_batch_size: must be positive"))
+	}
+	if nc.Sync.PollInterval < 0 {
+		errs = append(errs, errors.New("invalid value for network.sync.poll_interval: must not be negative"))
+	} else if nc.Sync.PollInterval > 0 && nc.IsSimulated() {
+		errs = append(errs, errors.New("network.sync.poll_interval requires network.api_base_url to be set"))
+	}
+	errs = append(errs, nc.RateLimits.Send.validate("send")...)
+	errs = append(errs, nc.RateLimits.History.validate("history")...)
+	errs = append(errs, nc.RateLimits.Profile.validate("profile")...)
+	errs = append(errs, nc.RateLimits.Media.validate("media")...)
+	if nc.Groups.MaxParticipants < 1 {
+		errs = append(errs, errors.New("invalid value for network.groups.max_participants: must be at least 1"))
+	}
+	if err := nc.PowerLevels.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, nc.Onboarding.compile()...)
+	if nc.Presence.MinInterval < 0 {
+		errs = append(errs, errors.New("invalid value for network.presence.min_interval: must not be negative"))
+	}
+	tpl, err := template.New("displayname").Parse(nc.DisplaynameTemplate)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid value for network.displayname_template: %w", err))
+	} else if err = tpl.Execute(io.Discard, &DisplaynameParams{}); err != nil {
+		errs = append(errs, fmt.Errorf("invalid value for network.displayname_template: %w", err))
+	} else {
+		nc.displaynameTemplate = tpl
+	}
+	return errors.Join(errs...)
+}
+
+// DisplaynameParams contains the remote profile fields available in the displayname template.
+type DisplaynameParams struct {
+	Name     string
+	Username string
+	Phone    string
+	IsBot    bool
+}
+
+// FormatDisplayname renders the displayname template for the given remote profile.
+// If the template produces an empty name, the username is used instead.
+func (nc *NetworkConfig) FormatDisplayname(params DisplaynameParams) string {
+	tpl := nc.displaynameTemplate
+	if tpl == nil {
+		// The config wasn't validated (e.g. the connector is used without mxmain), so compile it lazily.
+		var err error
+		tpl, err = template.New("displayname").Parse(nc.DisplaynameTemplate)
+		if err != nil {
+			return params.Username
+		}
+		nc.displaynameTemplate = tpl
+	}
+	var buf strings.Builder
+	err := tpl.Execute(&buf, &params)
+	if err != nil || strings.TrimSpace(buf.String()) == "" {
+		return params.Username
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+func upgradeConfig(helper up.Helper) {
+	// api_url was renamed to api_base_url
+	if oldURL, ok := helper.Get(up.Str, "api_url"); ok {
+		helper.Set(up.Str, oldURL, "api_base_url")
+	} else {
+		helper.Copy(up.Str, "api_base_url")
+	}
+	// timeout (integer seconds) was replaced by request_timeout (duration string)
+	if oldTimeout, ok := helper.Get(up.Int, "timeout"); ok {
+		if seconds, err := strconv.Atoi(oldTimeout); err == nil {
+			helper.Set(up.Str, (time.Duration(seconds) * time.Second).String(), "request_timeout")
+		}
+	} else {
+		helper.Copy(up.Str, "request_timeout")
+	}
+	helper.Copy(up.Str, "connect_timeout")
+
+	helper.Copy(up.Int, "sync", "chat_limit")
+	helper.Copy(up.Int, "sync", "backfill_batch_size")
+	helper.Copy(up.Str, "sync", "poll_interval")
+
+	for _, class := range []string{"send", "history", "profile", "media"} {
+		helper.Copy(up.Float|up.Int, "rate_limits", class, "per_second")
+		helper.Copy(up.Int, "rate_limits", class, "burst")
+	}
+
+	helper.Copy(up.Int, "groups", "max_participants")
+	for _, role := range []string{"owner", "admin", "moderator", "member", "restricted"} {
+		helper.Copy(up.Int, "power_levels", role)
+	}
+
+	helper.Copy(up.Bool, "onboarding", "enabled")
+	helper.Copy(up.Str, "onboarding", "room_name")
+	helper.Copy(up.Str, "onboarding", "room_topic")
+	helper.Copy(up.Str, "onboarding", "greeting")
+	helper.Copy(up.Str, "onboarding", "help")
+
+	helper.Copy(up.Bool, "presence", "receive")
+	helper.Copy(up.Bool, "presence", "send")
+	helper.Copy(up.Str, "presence", "min_interval")
+
+	helper.Copy(up.Str, "displayname_template")
+	helper.Copy(up.Bool, "contact_names_in_dms")
+}
+
+// GetConfig implements bridgev2.NetworkConnector.
+func (c *MyConnector) GetConfig() (string, any, up.Upgrader) {
+	return ExampleConfig, &c.Config, &up.StructUpgrader{
+		SimpleUpgrader: upgradeConfig,
+		Blocks: [][]string{
+			{"sync"},
+			{"rate_limits"},
+			{"groups"},
+			{"power_levels"},
+			{"onboarding"},
+			{"presence"},
+			{"displayname_template"},
+			{"contact_names_in_dms"},
+		},
+		Base: ExampleConfig,
+	}
+}
+
+// Ensure MyConnector implements ConfigValidatingNetwork.
+var _ bridgev2.ConfigValidatingNetwork = (*MyConnector)(nil)
+
+// ValidateConfig implements bridgev2.ConfigValidatingNetwork.
+func (c *MyConnector) ValidateConfig() error {
+	return c.Config.validate()
+}
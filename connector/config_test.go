@@ -0,0 +1,220 @@
+package connector
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	up "go.mau.fi/util/configupgrade"
+	"gopkg.in/yaml.v3"
+)
+
+// upgradeTestConfig runs upgradeConfig on the given network config, like the bridge does on startup, and
+// returns the parsed result.
+func upgradeTestConfig(t *testing.T, input string) NetworkConfig {
+	t.Helper()
+	var base, cfg yaml.Node
+	if err := yaml.Unmarshal([]byte(ExampleConfig), &base); err != nil {
+		t.Fatalf("failed to parse example config: %v", err)
+	}
+	if err := yaml.Unmarshal([]byte(input), &cfg); err != nil {
+		t.Fatalf("failed to parse test config: %v", err)
+	}
+	upgradeConfig(up.NewHelper(&base, &cfg))
+	output, err := yaml.Marshal(&base)
+	if err != nil {
+		t.Fatalf("failed to marshal upgraded config: %v", err)
+	}
+	var parsed NetworkConfig
+	if err = yaml.Unmarshal(output, &parsed); err != nil {
+		t.Fatalf("failed to parse upgraded config: %v", err)
+	}
+	return parsed
+}
+
+func TestUpgradeConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		check func(t *testing.T, cfg NetworkConfig)
+	}{{
+		name:  "empty config gets example defaults",
+		input: "{}",
+		check: func(t *testing.T, cfg NetworkConfig) {
+			if cfg.APIBaseURL != "" || cfg.RequestTimeout != 30*time.Second || cfg.ConnectTimeout != 15*time.Second {
+				t.Errorf("unexpected defaults: api_base_url=%q request_timeout=%s connect_timeout=%s",
+					cfg.APIBaseURL, cfg.RequestTimeout, cfg.ConnectTimeout)
+			}
+		},
+	}, {
+		name:  "api_url is renamed to api_base_url",
+		input: "api_url: https://old.example.org/api",
+		check: func(t *testing.T, cfg NetworkConfig) {
+			if cfg.APIBaseURL != "https://old.example.org/api" {
+				t.Errorf("expected api_base_url from api_url, got %q", cfg.APIBaseURL)
+			}
+		},
+	}, {
+		name:  "api_url takes precedence over api_base_url",
+		input: "api_url: https://old.example.org/api\napi_base_url: https://new.example.org/api",
+		check: func(t *testing.T, cfg NetworkConfig) {
+			if cfg.APIBaseURL != "https://old.example.org/api" {
+				t.Errorf("expected api_base_url from api_url, got %q", cfg.APIBaseURL)
+			}
+		},
+	}, {
+		name:  "api_base_url is kept",
+		input: "api_base_url: https://new.example.org/api",
+		check: func(t *testing.T, cfg NetworkConfig) {
+			if cfg.APIBaseURL != "https://new.example.org/api" {
+				t.Errorf("expected api_base_url to be kept, got %q", cfg.APIBaseURL)
+			}
+		},
+	}, {
+		name:  "timeout in seconds becomes request_timeout",
+		input: "timeout: 45",
+		check: func(t *testing.T, cfg NetworkConfig) {
+			if cfg.RequestTimeout != 45*time.Second {
+				t.Errorf("expected request_timeout of 45s, got %s", cfg.RequestTimeout)
+			}
+		},
+	}, {
+		name:  "request_timeout is kept",
+		input: "request_timeout: 1m",
+		check: func(t *testing.T, cfg NetworkConfig) {
+			if cfg.RequestTimeout != time.Minute {
+				t.Errorf("expected request_timeout of 1m, got %s", cfg.RequestTimeout)
+			}
+		},
+	}, {
+		name:  "nested sections are copied",
+		input: "api_base_url: https://remote.example.org/api\nsync:\n    chat_limit: 0\n    poll_interval: 10s\nrate_limits:\n    send:\n        per_second: 2\n        burst: 4\npower_levels:\n    owner: 90",
+		check: func(t *testing.T, cfg NetworkConfig) {
+			if cfg.Sync.ChatLimit != 0 || cfg.Sync.PollInterval != 10*time.Second {
+				t.Errorf("unexpected sync section: %+v", cfg.Sync)
+			}
+			if cfg.RateLimits.Send != (RateLimit{PerSecond: 2, Burst: 4}) {
+				t.Errorf("unexpected send rate limit: %+v", cfg.RateLimits.Send)
+			}
+			if cfg.PowerLevels.Owner != 90 || cfg.PowerLevels.Admin != 75 {
+				t.Errorf("unexpected power levels: %+v", cfg.PowerLevels)
+			}
+		},
+	}, {
+		name:  "fractional rate limits are copied",
+		input: "rate_limits:\n    history:\n        per_second: 0.5\n        burst: 1",
+		check: func(t *testing.T, cfg NetworkConfig) {
+			if cfg.RateLimits.History.PerSecond != 0.5 {
+				t.Errorf("expected history per_second of 0.5, got %v", cfg.RateLimits.History.PerSecond)
+			}
+		},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := upgradeTestConfig(t, test.input)
+			test.check(t, cfg)
+			if err := cfg.validate(); err != nil {
+				t.Errorf("upgraded config doesn't validate: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(cfg *NetworkConfig)
+		wantErr []string
+	}{{
+		name:   "example config",
+		modify: func(cfg *NetworkConfig) {},
+	}, {
+		name: "remote api with polling",
+		modify: func(cfg *NetworkConfig) {
+			cfg.APIBaseURL = "https://remote.example.org/api"
+			cfg.Sync.PollInterval = 5 * time.Second
+		},
+	}, {
+		name:    "api_base_url with unsupported scheme",
+		modify:  func(cfg *NetworkConfig) { cfg.APIBaseURL = "ftp://remote.example.org" },
+		wantErr: []string{"network.api_base_url: scheme must be http or https"},
+	}, {
+		name:    "api_base_url without host",
+		modify:  func(cfg *NetworkConfig) { cfg.APIBaseURL = "https:///api" },
+		wantErr: []string{"network.api_base_url: host is missing"},
+	}, {
+		name:    "api_base_url with query",
+		modify:  func(cfg *NetworkConfig) { cfg.APIBaseURL = "https://remote.example.org/api?key=1" },
+		wantErr: []string{"network.api_base_url: must not contain a query or fragment"},
+	}, {
+		name: "non-positive timeouts",
+		modify: func(cfg *NetworkConfig) {
+			cfg.RequestTimeout = 0
+			cfg.ConnectTimeout = -time.Second
+		},
+		wantErr: []string{"network.request_timeout: must be positive", "network.connect_timeout: must be positive"},
+	}, {
+		name:    "negative chat_limit",
+		modify:  func(cfg *NetworkConfig) { cfg.Sync.ChatLimit = -1 },
+		wantErr: []string{"network.sync.chat_limit: must not be negative"},
+	}, {
+		name:    "zero backfill_batch_size",
+		modify:  func(cfg *NetworkConfig) { cfg.Sync.BackfillBatchSize = 0 },
+		wantErr: []string{"network.sync.backfill_batch_size: must be positive"},
+	}, {
+		name:    "poll_interval without remote api",
+		modify:  func(cfg *NetworkConfig) { cfg.Sync.PollInterval = time.Minute },
+		wantErr: []string{"network.sync.poll_interval requires network.api_base_url"},
+	}, {
+		name: "invalid rate limits",
+		modify: func(cfg *NetworkConfig) {
+			cfg.RateLimits.Media.PerSecond = -1
+			cfg.RateLimits.Profile = RateLimit{PerSecond: 1, Burst: 0}
+		},
+		wantErr: []string{"network.rate_limits.media.per_second: must not be negative", "network.rate_limits.profile.burst: must be at least 1"},
+	}, {
+		name:    "zero max_participants",
+		modify:  func(cfg *NetworkConfig) { cfg.Groups.MaxParticipants = 0 },
+		wantErr: []string{"network.groups.max_participants: must be at least 1"},
+	}, {
+		name:    "power levels out of order",
+		modify:  func(cfg *NetworkConfig) { cfg.PowerLevels.Moderator = cfg.PowerLevels.Admin },
+		wantErr: []string{"network.power_levels: levels must be strictly decreasing"},
+	}, {
+		name:    "broken onboarding template",
+		modify:  func(cfg *NetworkConfig) { cfg.Onboarding.Greeting = "Hi {{.RemoteName" },
+		wantErr: []string{"network.onboarding.greeting"},
+	}, {
+		name:    "onboarding template with unknown field",
+		modify:  func(cfg *NetworkConfig) { cfg.Onboarding.Help = "{{.Unknown}}" },
+		wantErr: []string{"network.onboarding.help"},
+	}, {
+		name:    "negative presence min_interval",
+		modify:  func(cfg *NetworkConfig) { cfg.Presence.MinInterval = -time.Second },
+		wantErr: []string{"network.presence.min_interval: must not be negative"},
+	}, {
+		name:    "displayname template with unknown field",
+		modify:  func(cfg *NetworkConfig) { cfg.DisplaynameTemplate = "{{.Nickname}}" },
+		wantErr: []string{"network.displayname_template"},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := upgradeTestConfig(t, "{}")
+			test.modify(&cfg)
+			err := cfg.validate()
+			if len(test.wantErr) == 0 {
+				if err != nil {
+					t.Errorf("expected no error, got %v", err)
+				}
+				return
+			} else if err == nil {
+				t.Fatalf("expected errors containing %q, got none", test.wantErr)
+			}
+			for _, want := range test.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("expected error containing %q, got %v", want, err)
+				}
+			}
+		})
+	}
+}
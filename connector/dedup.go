@@ -0,0 +1,201 @@
+package connector
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+)
+
+// dedupCacheSize is the number of recently queued events remembered per login.
+const dedupCacheSize = 4096
+
+// DedupMetrics counts the remote events that were dropped as duplicates.
+type DedupMetrics struct {
+	Messages  uint64 `json:"messages"`
+	Edits     uint64 `json:"edits"`
+	Reactions uint64 `json:"reactions"`
+	Receipts  uint64 `json:"receipts"`
+}
+
+// Total returns the number of dropped events of all types.
+func (dm DedupMetrics) Total() uint64 {
+	return dm.Messages + dm.Edits + dm.Reactions + dm.Receipts
+}
+
+// eventDeduplicator drops remote events that have already been bridged before they reach the bridge queue.
+//
+// Remote networks redeliver events after reconnects, so every event is checked against an in-memory
+// LRU of recently queued events and, for events that leave a trace in the database (messages and
+// reactions), against the database. The LRU also covers events that are still in the bridge queue
+// and therefore not in the database yet.
+//
+// Removing a reaction marks it as removed in the LRU, so that adding the same reaction again isn't dropped,
+// even while the removal is still in the bridge queue and the reaction is in the database.
+type eventDeduplicator struct {
+	bridge *bridgev2.Bridge
+
+	lock   sync.Mutex
+	recent map[string]*list.Element
+	order  *list.List
+	size   int
+
+	droppedMessages  atomic.Uint64
+	droppedEdits     atomic.Uint64
+	droppedReactions atomic.Uint64
+	droppedReceipts  atomic.Uint64
+}
+
+func newEventDeduplicator(bridge *bridgev2.Bridge, size int) *eventDeduplicator {
+	return &eventDeduplicator{
+		bridge: bridge,
+		recent: make(map[string]*list.Element, size),
+		order:  list.New(),
+		size:   size,
+	}
+}
+
+// Metrics returns a snapshot of the duplicate counters.
+func (ed *eventDeduplicator) Metrics() DedupMetrics {
+	return DedupMetrics{
+		Messages:  ed.droppedMessages.Load(),
+		Edits:     ed.droppedEdits.Load(),
+		Reactions: ed.droppedReactions.Load(),
+		Receipts:  ed.droppedReceipts.Load(),
+	}
+}
+
+// dedupEntry is an event in the LRU.
+type dedupEntry struct {
+	key string
+	// removed is set for reactions that have been removed since they were queued.
+	removed bool
+}
+
+// dedupKey returns the identity of a remote event, or an empty string if the event type isn't deduplicated.
+// Upserts aren't deduplicated, as they're meant to be applied to messages that already exist.
+func dedupKey(evt bridgev2.RemoteEvent) string {
+	portalKey := evt.GetPortalKey()
+	prefix := fmt.Sprintf("%s|%s|", portalKey.ID, portalKey.Receiver)
+	switch evt.GetType() {
+	case bridgev2.RemoteEventMessage:
+		return prefix + "message|" + string(evt.(bridgev2.RemoteMessage).GetID())
+	case bridgev2.RemoteEventEdit:
+		edit := evt.(bridgev2.RemoteEdit)
+		withTS, ok := evt.(bridgev2.RemoteEventWithTimestamp)
+		if !ok || withTS.GetTimestamp().IsZero() {
+			// Without a timestamp, two different edits of the same message can't be told apart.
+			return ""
+		}
+		return fmt.Sprintf("%sedit|%s|%d", prefix, edit.GetTargetMessage(), withTS.GetTimestamp().UnixMilli())
+	case bridgev2.RemoteEventReaction:
+		reaction := evt.(bridgev2.RemoteReaction)
+		_, emojiID := reaction.GetReactionEmoji()
+		return fmt.Sprintf("%sreaction|%s|%s|%s", prefix, reaction.GetTargetMessage(), evt.GetSender().Sender, emojiID)
+	case bridgev2.RemoteEventReactionRemove:
+		// Removals aren't deduplicated themselves, but share the key of the reaction they remove.
+		removal := evt.(bridgev2.RemoteReactionRemove)
+		return fmt.Sprintf("%sreaction|%s|%s|%s", prefix, removal.GetTargetMessage(), evt.GetSender().Sender, removal.GetRemovedEmojiID())
+	case bridgev2.RemoteEventReadReceipt:
+		receipt := evt.(bridgev2.RemoteReadReceipt)
+		return fmt.Sprintf("%sreceipt|%s|%s", prefix, evt.GetSender().Sender, receipt.GetLastReceiptTarget())
+	default:
+		return ""
+	}
+}
+
+// IsDuplicate checks whether the event has already been queued or bridged and counts it if so.
+// Events that aren't duplicates are remembered, so calling this twice for the same event returns true the second time.
+func (ed *eventDeduplicator) IsDuplicate(ctx context.Context, evt bridgev2.RemoteEvent) bool {
+	key := dedupKey(evt)
+	if key == "" {
+		return false
+	} else if evt.GetType() == bridgev2.RemoteEventReactionRemove {
+		ed.markRemoved(key)
+		return false
+	}
+	recent, removed := ed.checkRecent(key)
+	duplicate := recent || (!removed && ed.checkDatabase(ctx, evt))
+	if !duplicate {
+		return false
+	}
+	switch evt.GetType() {
+	case bridgev2.RemoteEventMessage:
+		ed.droppedMessages.Add(1)
+	case bridgev2.RemoteEventEdit:
+		ed.droppedEdits.Add(1)
+	case bridgev2.RemoteEventReaction:
+		ed.droppedReactions.Add(1)
+	case bridgev2.RemoteEventReadReceipt:
+		ed.droppedReceipts.Add(1)
+	}
+	return true
+}
+
+// checkRecent returns true if the key is in the LRU. Otherwise, the key is added to it. If the key belongs to
+// a removed reaction, it's not a duplicate and removed is true, as the database may still contain the reaction.
+func (ed *eventDeduplicator) checkRecent(key string) (recent, removed bool) {
+	ed.lock.Lock()
+	defer ed.lock.Unlock()
+	if elem, ok := ed.recent[key]; ok {
+		ed.order.MoveToFront(elem)
+		entry := elem.Value.(*dedupEntry)
+		if entry.removed {
+			entry.removed = false
+			return false, true
+		}
+		return true, false
+	}
+	ed.add(&dedupEntry{key: key})
+	return false, false
+}
+
+// markRemoved marks the reaction with the given key as removed.
+func (ed *eventDeduplicator) markRemoved(key string) {
+	ed.lock.Lock()
+	defer ed.lock.Unlock()
+	if elem, ok := ed.recent[key]; ok {
+		ed.order.MoveToFront(elem)
+		elem.Value.(*dedupEntry).removed = true
+		return
+	}
+	ed.add(&dedupEntry{key: key, removed: true})
+}
+
+// add puts an entry at the front of the LRU and evicts the oldest one if it's full. The lock must be held.
+func (ed *eventDeduplicator) add(entry *dedupEntry) {
+	ed.recent[entry.key] = ed.order.PushFront(entry)
+	if ed.order.Len() > ed.size {
+		oldest := ed.order.Back()
+		ed.order.Remove(oldest)
+		delete(ed.recent, oldest.Value.(*dedupEntry).key)
+	}
+}
+
+// checkDatabase returns true if the event has already been stored by the bridge.
+// Edits and receipts aren't stored individually, so they're only deduplicated by the LRU.
+func (ed *eventDeduplicator) checkDatabase(ctx context.Context, evt bridgev2.RemoteEvent) bool {
+	receiver := evt.GetPortalKey().Receiver
+	var exists bool
+	var err error
+	switch evt.GetType() {
+	case bridgev2.RemoteEventMessage:
+		existing, dbErr := ed.bridge.DB.Message.GetFirstPartByID(ctx, receiver, evt.(bridgev2.RemoteMessage).GetID())
+		exists, err = existing != nil, dbErr
+	case bridgev2.RemoteEventReaction:
+		reaction := evt.(bridgev2.RemoteReaction)
+		_, emojiID := reaction.GetReactionEmoji()
+		existing, dbErr := ed.bridge.DB.Reaction.GetByIDWithoutMessagePart(ctx, receiver, reaction.GetTargetMessage(), evt.GetSender().Sender, emojiID)
+		exists, err = existing != nil, dbErr
+	}
+	if err != nil {
+		// Let the bridge handle the event rather than risking losing it.
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to check database for duplicate event")
+		return false
+	}
+	return exists
+}
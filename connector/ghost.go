@@ -0,0 +1,109 @@
+package connector
+
+import (
+	"context"
+
+	"go.mau.fi/util/dbutil"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// kvDisplaynameTemplate stores the displayname template that the existing ghost names were rendered with.
+const kvDisplaynameTemplate database.Key = "simplenetwork_displayname_template"
+
+// userInfoFromMetadata builds the ghost info for a cached remote profile.
+func (c *MyConnector) userInfoFromMetadata(meta *GhostMetadata) *bridgev2.UserInfo {
+	updateMeta := updateGhostMetadata(*meta)
+	info := &bridgev2.UserInfo{
+		Name:  ptr.Ptr(c.Config.FormatDisplayname(meta.DisplaynameParams())),
+		IsBot: ptr.Ptr(meta.IsBot),
+		ExtraUpdates: func(ctx context.Context, ghost *bridgev2.Ghost) bool {
+			if !updateMeta(ctx, ghost) {
+				return false
+			}
+			// The name or avatar may have changed with the profile, which replaced the contact names in DMs.
+			c.reapplyContactNames(ctx, ghost)
+			return true
+		},
+	}
+	if meta.Phone != "" {
+		info.Identifiers = []string{"tel:" + meta.Phone}
+	}
+	return info
+}
+
+// userInfo returns the ghost info for a remote profile, including the avatar,
+// which is downloaded through the remote API.
+func (nc *MyNetworkClient) userInfo(meta *GhostMetadata) *bridgev2.UserInfo {
+	info := nc.connector.userInfoFromMetadata(meta)
+	info.Avatar = nc.makeAvatar(meta.AvatarURL)
+	return info
+}
+
+// makeAvatar returns an avatar that's downloaded from the given remote URL. The URL is used as the
+// avatar ID, so it's only downloaded again when it changes. An empty URL removes the avatar.
+func (nc *MyNetworkClient) makeAvatar(avatarURL string) *bridgev2.Avatar {
+	if avatarURL == "" {
+		return &bridgev2.Avatar{Remove: true}
+	}
+	return &bridgev2.Avatar{
+		ID: networkid.AvatarID(avatarURL),
+		Get: func(ctx context.Context) ([]byte, error) {
+			return nc.remote.Download(ctx, avatarURL)
+		},
+	}
+}
+
+// updateGhostMetadata returns an updater that stores the given remote profile in the ghost metadata.
+func updateGhostMetadata(meta GhostMetadata) bridgev2.ExtraUpdater[*bridgev2.Ghost] {
+	return func(ctx context.Context, ghost *bridgev2.Ghost) bool {
+		current := ghost.Metadata.(*GhostMetadata)
+		if *current == meta {
+			return false
+		}
+		*current = meta
+		return true
+	}
+}
+
+// rerenderGhostNames re-renders the names of all existing ghosts if the displayname template
+// has changed since the last time the bridge was started.
+func (c *MyConnector) rerenderGhostNames(ctx context.Context) {
+	log := c.log.With().Str("action", "rerender ghost names").Logger()
+	ctx = log.WithContext(ctx)
+
+	if c.bridge.DB.KV.Get(ctx, kvDisplaynameTemplate) == c.Config.DisplaynameTemplate {
+		return
+	}
+	ghostIDs, err := dbutil.ConvertRowFn[networkid.UserID](dbutil.ScanSingleColumn[networkid.UserID]).
+		NewRowIter(c.bridge.DB.Query(ctx, "SELECT id FROM ghost WHERE bridge_id=$1", c.bridge.ID)).
+		AsList()
+	if err != nil {
+		log.Err(err).Msg("Failed to get ghost list")
+		return
+	}
+	log.Info().Int("ghost_count", len(ghostIDs)).Msg("Displayname template changed, updating ghost names")
+	for _, ghostID := range ghostIDs {
+		ghost, err := c.bridge.GetGhostByID(ctx, ghostID)
+		if err != nil {
+			log.Err(err).Str("ghost_id", string(ghostID)).Msg("Failed to get ghost")
+			continue
+		}
+		meta := ghost.Metadata.(*GhostMetadata)
+		if meta.Username == "" && meta.RemoteName == "" {
+			// Ghosts whose profile was never fetched will be rendered when the info is first requested.
+			continue
+		}
+		if ghost.UpdateName(ctx, c.Config.FormatDisplayname(meta.DisplaynameParams())) {
+			c.reapplyContactNames(ctx, ghost)
+		}
+		err = c.bridge.DB.Ghost.Update(ctx, ghost.Ghost)
+		if err != nil {
+			log.Err(err).Str("ghost_id", string(ghostID)).Msg("Failed to save ghost after updating name")
+		}
+	}
+	c.bridge.DB.KV.Set(ctx, kvDisplaynameTemplate, c.Config.DisplaynameTemplate)
+	log.Info().Msg("Finished updating ghost names")
+}
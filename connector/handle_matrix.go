@@ -5,6 +5,8 @@ import (
 	"fmt"
 
 	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
 	"maunium.net/go/mautrix/event"
 )
 
@@ -22,38 +24,77 @@ func (nc *MyNetworkClient) HandleMatrixMessage(ctx context.Context, msg *bridgev
 	_, err := nc.bridge.GetExistingUserByMXID(ctx, msg.Event.Sender)
 	if err != nil {
 		log.Err(err).Str("user_mxid", string(msg.Event.Sender)).Msg("Failed to get user object, ignoring message")
-		return nil, nil
+		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
+	if nc.isSystemPortal(msg.Portal) {
+		return nc.handleSystemCommand(ctx, msg)
+	}
+	meta := msg.Portal.Metadata.(*PortalMetadata)
+	if !meta.GetChatType().CanSend(meta.RoleOf(nc.remoteUserID())) {
+		return nil, ErrReadOnlyChat
+	}
+	// The remote only accepts plain text, anything else would be lost without the sender noticing.
+	switch msg.Content.MsgType {
+	case event.MsgText, event.MsgNotice:
+	default:
+		return nil, bridgev2.ErrUnsupportedMessageType
+	}
+	if msg.Content.RelatesTo.GetReplyTo() != "" || msg.Content.RelatesTo.GetThreadParent() != "" {
+		return nil, ErrRepliesNotSupported
+	}
+
+	// The remote echoes the transaction ID back with the sent message, which lets the outbox drop the echo.
+	txnID := networkid.TransactionID(msg.InputTransactionID)
+	if txnID == "" {
+		txnID = networkid.TransactionID(nc.connector.GenerateTransactionID(msg.Event.Sender, msg.Portal.MXID, msg.Event.Type))
+	}
+
+	// The outbox sends the message in the background and retries transient failures. Once the remote
+	// has accepted it, the outbox saves it to the database and reports the delivery status to Matrix.
+	// If the echo arrives before that, the bridge saves the message from the echo instead.
+	msg.AddPendingToSave(&database.Message{
+		SenderMXID: msg.Event.Sender,
+		SendTxnID:  networkid.RawTransactionID(txnID),
+	}, txnID, nc.handleRemoteEcho)
+	err = nc.outbox.Enqueue(ctx, msg, txnID)
+	if err != nil {
+		msg.RemovePending(txnID)
+		return nil, fmt.Errorf("failed to queue message: %w", err)
+	}
+	log.Debug().Str("txn_id", string(txnID)).Msg("Queued message for sending")
 
-	nc.QueueRemoteMessage(ctx, msg.Portal.ID, "Hi there too")
+	return &bridgev2.MatrixMessageResponse{Pending: true}, nil
+}
 
-	return &bridgev2.MatrixMessageResponse{}, nil
+// handleRemoteEcho is called by the bridge when the echo of a queued message arrives before the outbox has saved
+// it. The bridge saves the message, the delivery status is sent by the outbox once the send has returned.
+func (nc *MyNetworkClient) handleRemoteEcho(evt bridgev2.RemoteMessage, dbMessage *database.Message) (bool, error) {
+	return true, bridgev2.ErrNoStatus
 }
 
-// GetUserInfo is not implemented for this simple connector.
+// GetUserInfo fetches the remote profile and returns the ghost info with the name rendered from the
+// displayname template. If the remote doesn't know the user, the cached profile in the ghost metadata is used.
 func (nc *MyNetworkClient) GetUserInfo(ctx context.Context, ghost *bridgev2.Ghost) (*bridgev2.UserInfo, error) {
-	return nil, fmt.Errorf("user info not available")
+	user, err := nc.remote.GetUser(ctx, ghost.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user profile: %w", err)
+	}
+	var profile GhostMetadata
+	if user != nil {
+		profile = user.ghostMetadata()
+	} else {
+		profile = *ghost.Metadata.(*GhostMetadata)
+	}
+	if profile.RemoteUserID == "" {
+		profile.RemoteUserID = string(ghost.ID)
+	}
+	if profile.Username == "" {
+		profile.Username = string(ghost.ID)
+	}
+	return nc.userInfo(&profile), nil
 }
 
 // GetChatInfo is not implemented for this simple connector.
 func (nc *MyNetworkClient) GetChatInfo(ctx context.Context, portal *bridgev2.Portal) (*bridgev2.ChatInfo, error) {
 	return nil, fmt.Errorf("chat info not available")
 }
-
-// GetCapabilities returns the supported features for chats handled by this client.
-func (nc *MyNetworkClient) GetCapabilities(ctx context.Context, portal *bridgev2.Portal) *event.RoomFeatures {
-	return &event.RoomFeatures{
-		MaxTextLength: 65536,
-		Formatting: event.FormattingFeatureMap{
-			event.FmtBold:          event.CapLevelFullySupported,
-			event.FmtItalic:        event.CapLevelFullySupported,
-			event.FmtUnderline:     event.CapLevelFullySupported,
-			event.FmtStrikethrough: event.CapLevelFullySupported,
-			event.FmtInlineCode:    event.CapLevelFullySupported,
-			event.FmtCodeBlock:     event.CapLevelFullySupported,
-		},
-		Edit:   event.CapLevelFullySupported,
-		Reply:  event.CapLevelFullySupported,
-		Thread: event.CapLevelFullySupported,
-	}
-}
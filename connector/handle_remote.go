@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/ptr"
 	"maunium.net/go/mautrix/bridgev2"
-	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/database"
 	"maunium.net/go/mautrix/bridgev2/simplevent"
+	"maunium.net/go/mautrix/bridgev2/status"
 	"maunium.net/go/mautrix/event"
 )
 
@@ -19,33 +22,282 @@ import (
 // - Connect to an upstream websocket
 // - Poll for messages
 
+// queueRemoteEvent passes a remote event to the bridge unless it has already been bridged or the login has logged out.
+// All remote events should go through here rather than calling bridge.QueueRemoteEvent directly.
+func (nc *MyNetworkClient) queueRemoteEvent(ctx context.Context, evt bridgev2.RemoteEvent) {
+	if nc.loggedOut.Load() {
+		zerolog.Ctx(ctx).Debug().Stringer("event_type", evt.GetType()).Msg("Dropping remote event received after logout")
+		return
+	} else if nc.dedup.IsDuplicate(ctx, evt) {
+		zerolog.Ctx(ctx).Debug().
+			Stringer("event_type", evt.GetType()).
+			Str("portal_id", string(evt.GetPortalKey().ID)).
+			Msg("Dropping duplicate remote event")
+		return
+	}
+	nc.bridge.QueueRemoteEvent(nc.login, evt)
+}
+
+// pollEvents polls the remote event feed every network.sync.poll_interval until ctx is cancelled.
+// The bridge state is set to transient disconnect while polling fails, and back to connected when it works again.
+func (nc *MyNetworkClient) pollEvents(ctx context.Context) {
+	log := zerolog.Ctx(ctx)
+	ticker := time.NewTicker(nc.connector.Config.Sync.PollInterval)
+	defer ticker.Stop()
+	failing := nc.login.BridgeState.GetPrev().StateEvent != status.StateConnected
+	for {
+		err := nc.pollOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		} else if err != nil && !failing {
+			log.Warn().Err(err).Msg("Failed to poll remote events")
+			nc.login.BridgeState.Send(status.BridgeState{
+				StateEvent: status.StateTransientDisconnect,
+				Error:      "simplenetwork-poll-failed",
+				Message:    fmt.Sprintf("Failed to get new events: %v", err),
+			})
+			failing = true
+		} else if err == nil && failing {
+			log.Info().Msg("Polling remote events works again")
+			nc.login.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnected})
+			failing = false
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pollOnce fetches all new events from the feed and queues them. The cursor is saved after every page,
+// so events aren't fetched again after a restart.
+func (nc *MyNetworkClient) pollOnce(ctx context.Context) error {
+	var since string
+	nc.withMetadata(func(meta *LoginMetadata) {
+		since = meta.EventCursor
+	})
+	for {
+		resp, err := nc.remote.GetEvents(ctx, &GetEventsRequest{Since: since})
+		if err != nil {
+			return fmt.Errorf("failed to get events: %w", err)
+		}
+		for _, evt := range resp.Events {
+			nc.handleNetworkEvent(ctx, evt)
+		}
+		if resp.Next != since {
+			since = resp.Next
+			err = nc.updateMetadata(ctx, func(meta *LoginMetadata) {
+				meta.EventCursor = since
+			})
+			if err != nil {
+				return fmt.Errorf("failed to save event cursor: %w", err)
+			}
+		}
+		if !resp.HasMore {
+			return nil
+		}
+	}
+}
+
+// handleNetworkEvent passes an event from the remote event feed to the matching handler.
+func (nc *MyNetworkClient) handleNetworkEvent(ctx context.Context, evt *NetworkEvent) {
+	switch {
+	case evt.Type == NetworkEventMessage && evt.Message != nil:
+		if evt.Message.EditedAt.IsZero() {
+			nc.QueueRemoteMessage(ctx, evt.Message)
+		} else {
+			nc.QueueRemoteEdit(ctx, evt.Message)
+		}
+	case evt.Type == NetworkEventReaction && evt.Reaction != nil:
+		nc.QueueRemoteReaction(ctx, evt.Reaction)
+	case evt.Type == NetworkEventReadReceipt && evt.ReadReceipt != nil:
+		nc.QueueRemoteReadReceipt(ctx, evt.ReadReceipt)
+	case evt.Type == NetworkEventMemberChange && evt.MemberChange != nil:
+		nc.QueueRemoteMemberChange(ctx, evt.MemberChange)
+	case evt.Type == NetworkEventChatUpdate && evt.ChatUpdate != nil:
+		nc.QueueRemoteChatUpdate(ctx, evt.ChatUpdate)
+	case evt.Type == NetworkEventPresence && evt.Presence != nil:
+		nc.HandleRemotePresence(ctx, evt.Presence)
+	default:
+		zerolog.Ctx(ctx).Warn().Str("event_type", string(evt.Type)).Msg("Ignoring unknown or empty remote event")
+	}
+}
+
 // QueueRemoteMessage shows the preferred Remote -> Matrix flow using the bridge event queue.
-func (nc *MyNetworkClient) QueueRemoteMessage(ctx context.Context, portalID networkid.PortalID, body string) {
-	evt := &simplevent.Message[string]{
+func (nc *MyNetworkClient) QueueRemoteMessage(ctx context.Context, msg *NetworkMessage) {
+	if nc.outbox.IsSentEcho(msg.TransactionID) {
+		zerolog.Ctx(ctx).Debug().Str("txn_id", string(msg.TransactionID)).Msg("Dropping echo of message saved by the outbox")
+		return
+	}
+	nc.queueRemoteEvent(ctx, &simplevent.Message[*NetworkMessage]{
 		EventMeta: simplevent.EventMeta{
-			Type:      bridgev2.RemoteEventMessage,
-			PortalKey: networkid.PortalKey{ID: portalID},
-			Sender: bridgev2.EventSender{
-				Sender:   networkid.UserID("example-ghost"),
-				IsFromMe: false,
-			},
+			Type:         bridgev2.RemoteEventMessage,
+			PortalKey:    nc.makePortalKey(msg.ChatID),
+			Sender:       nc.makeEventSender(ctx, msg.SenderID),
 			CreatePortal: true,
-			Timestamp:    time.Now(),
+			Timestamp:    msg.Timestamp,
 		},
-		Data: body,
-		ID:   networkid.MessageID(fmt.Sprintf("remote-%s-%d", portalID, time.Now().UnixNano())),
-		ConvertMessageFunc: func(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, data string) (*bridgev2.ConvertedMessage, error) {
-			return &bridgev2.ConvertedMessage{
-				Parts: []*bridgev2.ConvertedMessagePart{{
-					Type: event.EventMessage,
-					Content: &event.MessageEventContent{
-						MsgType: event.MsgText,
-						Body:    data,
-					},
-				}},
-			}, nil
+		Data:               msg,
+		ID:                 MakeMessageID(msg.ChatID, msg.ID),
+		TransactionID:      msg.TransactionID,
+		ConvertMessageFunc: nc.convertNetworkMessage,
+	})
+}
+
+// QueueRemoteEdit bridges an edited remote message. The edit timestamp identifies the edit,
+// so the same edit delivered twice is only applied once.
+func (nc *MyNetworkClient) QueueRemoteEdit(ctx context.Context, msg *NetworkMessage) {
+	nc.queueRemoteEvent(ctx, &simplevent.Message[*NetworkMessage]{
+		EventMeta: simplevent.EventMeta{
+			Type:      bridgev2.RemoteEventEdit,
+			PortalKey: nc.makePortalKey(msg.ChatID),
+			Sender:    nc.makeEventSender(ctx, msg.SenderID),
+			Timestamp: msg.EditedAt,
 		},
+		Data:            msg,
+		ID:              MakeMessageID(msg.ChatID, msg.ID),
+		TargetMessage:   MakeMessageID(msg.ChatID, msg.ID),
+		ConvertEditFunc: nc.convertNetworkEdit,
+	})
+}
+
+// QueueRemoteReaction bridges a remote reaction or its removal.
+func (nc *MyNetworkClient) QueueRemoteReaction(ctx context.Context, reaction *NetworkReaction) {
+	evtType := bridgev2.RemoteEventReaction
+	if reaction.Removed {
+		evtType = bridgev2.RemoteEventReactionRemove
 	}
+	nc.queueRemoteEvent(ctx, &simplevent.Reaction{
+		EventMeta: simplevent.EventMeta{
+			Type:      evtType,
+			PortalKey: nc.makePortalKey(reaction.ChatID),
+			Sender:    nc.makeEventSender(ctx, reaction.SenderID),
+			Timestamp: reaction.Timestamp,
+		},
+		TargetMessage: MakeMessageID(reaction.ChatID, reaction.MessageID),
+		EmojiID:       MakeEmojiID(reaction.Emoji),
+		Emoji:         reaction.Emoji,
+	})
+}
 
-	nc.bridge.QueueRemoteEvent(nc.login, evt)
+// QueueRemoteReadReceipt bridges a remote read receipt.
+func (nc *MyNetworkClient) QueueRemoteReadReceipt(ctx context.Context, receipt *NetworkReadReceipt) {
+	nc.queueRemoteEvent(ctx, &simplevent.Receipt{
+		EventMeta: simplevent.EventMeta{
+			Type:      bridgev2.RemoteEventReadReceipt,
+			PortalKey: nc.makePortalKey(receipt.ChatID),
+			Sender:    nc.makeEventSender(ctx, receipt.SenderID),
+			Timestamp: receipt.Timestamp,
+		},
+		LastTarget: MakeMessageID(receipt.ChatID, receipt.MessageID),
+	})
+}
+
+// QueueRemoteMemberChange bridges a remote membership change, such as a user being added to or removed from a group,
+// or a member being promoted or demoted.
+// The member event is sent by the user who made the change, and the reason is included in it.
+func (nc *MyNetworkClient) QueueRemoteMemberChange(ctx context.Context, change *NetworkMemberChange) {
+	member := bridgev2.ChatMember{
+		EventSender:  nc.makeEventSender(ctx, change.UserID),
+		Membership:   change.Action.Membership(),
+		MemberSender: nc.makeEventSender(ctx, change.SenderID),
+	}
+	if change.Action == MemberActionUnban {
+		member.PrevMembership = event.MembershipBan
+	}
+	if change.Reason != "" {
+		member.MemberEventExtra = map[string]any{"reason": change.Reason}
+	}
+	var info *bridgev2.ChatInfo
+	if change.Action == MemberActionSetRole {
+		member.PowerLevel = ptr.Ptr(nc.connector.Config.PowerLevels.ForRole(change.Role))
+		info = &bridgev2.ChatInfo{ExtraUpdates: setPortalRole(change.UserID, change.Role)}
+	} else if member.Membership != event.MembershipJoin {
+		info = &bridgev2.ChatInfo{ExtraUpdates: setPortalRole(change.UserID, RoleMember)}
+	}
+	nc.queueRemoteEvent(ctx, &simplevent.ChatInfoChange{
+		EventMeta: simplevent.EventMeta{
+			Type:      bridgev2.RemoteEventChatInfoChange,
+			PortalKey: nc.makePortalKey(change.ChatID),
+			Sender:    nc.makeEventSender(ctx, change.SenderID),
+			Timestamp: change.Timestamp,
+		},
+		ChatInfoChange: &bridgev2.ChatInfoChange{
+			ChatInfo: info,
+			MemberChanges: &bridgev2.ChatMemberList{
+				MemberMap: bridgev2.ChatMemberMap{change.UserID: member},
+			},
+		},
+	})
+}
+
+// QueueRemoteChatUpdate bridges a change to the name, topic, avatar or disappearing message timer of a remote chat.
+func (nc *MyNetworkClient) QueueRemoteChatUpdate(ctx context.Context, update *NetworkChatUpdate) {
+	info := &bridgev2.ChatInfo{
+		Name:         update.Name,
+		Topic:        update.Topic,
+		ExtraUpdates: updatePortalNameAndTopic(update.Name, update.Topic),
+	}
+	if update.AvatarURL != nil {
+		info.Avatar = nc.makeAvatar(*update.AvatarURL)
+	}
+	if update.DisappearTimer != nil {
+		info.Disappear = ptr.Ptr(disappearingSetting(*update.DisappearTimer))
+	}
+	nc.queueRemoteEvent(ctx, &simplevent.ChatInfoChange{
+		EventMeta: simplevent.EventMeta{
+			Type:      bridgev2.RemoteEventChatInfoChange,
+			PortalKey: nc.makePortalKey(update.ChatID),
+			Sender:    nc.makeEventSender(ctx, update.SenderID),
+			Timestamp: update.Timestamp,
+		},
+		ChatInfoChange: &bridgev2.ChatInfoChange{ChatInfo: info},
+	})
+}
+
+// convertNetworkMessage converts a remote message into Matrix content. The text is the first part, followed by
+// one part for every attachment. It's shared by live events and backfill so that both produce identical parts.
+func (nc *MyNetworkClient) convertNetworkMessage(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, msg *NetworkMessage) (*bridgev2.ConvertedMessage, error) {
+	converted := &bridgev2.ConvertedMessage{
+		// The bridge redacts the message once the timer has passed, counting from the message timestamp.
+		Disappear: disappearingSetting(msg.DisappearTimer),
+	}
+	if msg.Text != "" || len(msg.Attachments) == 0 {
+		converted.Parts = append(converted.Parts, convertNetworkText(msg))
+	}
+	for _, att := range msg.Attachments {
+		content, err := nc.convertAttachment(ctx, portal, intent, msg, att)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert attachment %s: %w", att.ID, err)
+		}
+		converted.Parts = append(converted.Parts, &bridgev2.ConvertedMessagePart{
+			ID:      MakePartID(len(converted.Parts)),
+			Type:    event.EventMessage,
+			Content: content,
+		})
+	}
+	return converted, nil
+}
+
+func convertNetworkText(msg *NetworkMessage) *bridgev2.ConvertedMessagePart {
+	return &bridgev2.ConvertedMessagePart{
+		ID:   MakePartID(0),
+		Type: event.EventMessage,
+		Content: &event.MessageEventContent{
+			MsgType: event.MsgText,
+			Body:    msg.Text,
+		},
+	}
+}
+
+// convertNetworkEdit converts an edited remote message into replacement content for the existing parts.
+// Only the text can be edited, which is always the first part.
+func (nc *MyNetworkClient) convertNetworkEdit(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, existing []*database.Message, msg *NetworkMessage) (*bridgev2.ConvertedEdit, error) {
+	if len(existing) <= len(msg.Attachments) {
+		return nil, fmt.Errorf("message doesn't have a text part to edit")
+	}
+	return &bridgev2.ConvertedEdit{
+		ModifiedParts: []*bridgev2.ConvertedEditPart{convertNetworkText(msg).ToEditPart(existing[0])},
+	}, nil
 }
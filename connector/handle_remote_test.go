@@ -0,0 +1,107 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPollOncePagesAndSavesCursor(t *testing.T) {
+	pages := map[string]*GetEventsResponse{
+		"":  {Next: "1", HasMore: true},
+		"1": {Next: "2", HasMore: true},
+		"2": {Next: "3"},
+		"3": {Next: "3"},
+	}
+	var requested []string
+	nc := newTestClient(t, NetworkConfig{}, &testRemote{
+		getEvents: func(ctx context.Context, req *GetEventsRequest) (*GetEventsResponse, error) {
+			requested = append(requested, req.Since)
+			return pages[req.Since], nil
+		},
+	})
+
+	if err := nc.pollOnce(context.Background()); err != nil {
+		t.Fatalf("pollOnce returned error: %v", err)
+	}
+	if len(requested) != 3 || requested[2] != "2" {
+		t.Errorf("expected pages \"\", 1 and 2 to be requested, got %q", requested)
+	}
+	if cursor := savedMetadata(t, nc).EventCursor; cursor != "3" {
+		t.Errorf("expected cursor 3 to be saved, got %q", cursor)
+	}
+
+	requested = nil
+	if err := nc.pollOnce(context.Background()); err != nil {
+		t.Fatalf("second pollOnce returned error: %v", err)
+	}
+	if len(requested) != 1 || requested[0] != "3" {
+		t.Errorf("expected the second poll to continue from cursor 3, got %q", requested)
+	}
+}
+
+func TestPollOnceKeepsCursorOfLastPageOnError(t *testing.T) {
+	nc := newTestClient(t, NetworkConfig{}, &testRemote{
+		getEvents: func(ctx context.Context, req *GetEventsRequest) (*GetEventsResponse, error) {
+			if req.Since == "" {
+				return &GetEventsResponse{Next: "1", HasMore: true}, nil
+			}
+			return nil, errors.New("remote unavailable")
+		},
+	})
+
+	if err := nc.pollOnce(context.Background()); err == nil {
+		t.Fatal("pollOnce should have returned the remote error")
+	}
+	if cursor := savedMetadata(t, nc).EventCursor; cursor != "1" {
+		t.Errorf("expected the cursor of the first page to be saved, got %q", cursor)
+	}
+}
+
+func TestPollingStopsOnDisconnect(t *testing.T) {
+	var polls atomic.Int32
+	nc := newTestClient(t, NetworkConfig{Sync: SyncConfig{PollInterval: 5 * time.Millisecond}}, &testRemote{
+		getEvents: func(ctx context.Context, req *GetEventsRequest) (*GetEventsResponse, error) {
+			polls.Add(1)
+			return &GetEventsResponse{}, nil
+		},
+	})
+
+	nc.startPolling()
+	// Starting again while running must not start a second poller.
+	nc.startPolling()
+	deadline := time.Now().Add(5 * time.Second)
+	for polls.Load() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("poller didn't poll")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	nc.Disconnect()
+	// A poll that had already started when Disconnect was called may still finish.
+	time.Sleep(20 * time.Millisecond)
+	stoppedAt := polls.Load()
+	time.Sleep(50 * time.Millisecond)
+	if polls.Load() != stoppedAt {
+		t.Errorf("poller kept polling after Disconnect: %d polls, then %d", stoppedAt, polls.Load())
+	}
+}
+
+func TestPollingDisabledWithoutInterval(t *testing.T) {
+	nc := newTestClient(t, NetworkConfig{}, &testRemote{
+		getEvents: func(ctx context.Context, req *GetEventsRequest) (*GetEventsResponse, error) {
+			t.Error("GetEvents shouldn't be called when polling is disabled")
+			return &GetEventsResponse{}, nil
+		},
+	})
+
+	nc.startPolling()
+	nc.pollLock.Lock()
+	running := nc.stopPolling != nil
+	nc.pollLock.Unlock()
+	if running {
+		t.Error("poller was started with a poll_interval of 0")
+	}
+}
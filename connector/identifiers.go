@@ -0,0 +1,72 @@
+package connector
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// Remote user IDs are the users' usernames, so the same rules apply to both.
+var usernameRegex = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+// Phone numbers are looked up in E.164 format without the leading +.
+var phoneRegex = regexp.MustCompile(`^[1-9][0-9]{6,14}$`)
+
+// Ensure MyConnector implements IdentifierValidatingNetwork.
+var _ bridgev2.IdentifierValidatingNetwork = (*MyConnector)(nil)
+
+// ValidateUserID implements bridgev2.IdentifierValidatingNetwork.
+func (c *MyConnector) ValidateUserID(id networkid.UserID) bool {
+	return usernameRegex.MatchString(string(id))
+}
+
+// LookupUserRequest asks the remote network for the user with the given identifier.
+// Exactly one of the fields is set.
+type LookupUserRequest struct {
+	Username string `json:"username,omitempty"`
+	Email    string `json:"email,omitempty"`
+	// Phone is the phone number in E.164 format without the leading +.
+	Phone string `json:"phone,omitempty"`
+}
+
+// parseIdentifier parses a user-provided identifier, which can be a username (optionally prefixed with @),
+// an email address or a phone number in international format (prefixed with + or tel:).
+// Malformed identifiers are rejected here so that they're never sent to the remote.
+func parseIdentifier(identifier string) (*LookupUserRequest, error) {
+	identifier = strings.TrimSpace(identifier)
+	switch {
+	case strings.HasPrefix(identifier, "+"), strings.HasPrefix(identifier, "tel:"):
+		phone := strings.Map(func(r rune) rune {
+			switch r {
+			case ' ', '-', '(', ')', '.':
+				return -1
+			}
+			return r
+		}, strings.TrimPrefix(strings.TrimPrefix(identifier, "tel:"), "+"))
+		if !phoneRegex.MatchString(phone) {
+			return nil, invalidIdentifier("%q is not a valid international phone number", identifier)
+		}
+		return &LookupUserRequest{Phone: phone}, nil
+	case strings.Contains(strings.TrimPrefix(identifier, "@"), "@"):
+		addr, err := mail.ParseAddress(identifier)
+		if err != nil || addr.Address != identifier {
+			return nil, invalidIdentifier("%q is not a valid email address", identifier)
+		}
+		return &LookupUserRequest{Email: strings.ToLower(addr.Address)}, nil
+	default:
+		username := strings.TrimPrefix(identifier, "@")
+		if !usernameRegex.MatchString(username) {
+			return nil, invalidIdentifier("%q is not a valid username", identifier)
+		}
+		return &LookupUserRequest{Username: username}, nil
+	}
+}
+
+func invalidIdentifier(format string, args ...any) error {
+	return bridgev2.WrapRespErr(fmt.Errorf(format, args...), mautrix.MInvalidParam)
+}
@@ -0,0 +1,142 @@
+package connector
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// Message IDs are derived from the remote network's own message identity, so the same remote
+// message always maps to the same ID no matter if it arrives live, is redelivered after a
+// reconnect or is fetched again during backfill. The bridge relies on that to deduplicate.
+//
+// The format is `<portal ID>:<remote message ID>` with both components query-escaped,
+// because remote message IDs are only guaranteed to be unique within a chat.
+
+// MakeMessageID returns the bridge message ID for a remote message in the given chat.
+func MakeMessageID(portalID networkid.PortalID, remoteMsgID string) networkid.MessageID {
+	return networkid.MessageID(url.QueryEscape(string(portalID)) + ":" + url.QueryEscape(remoteMsgID))
+}
+
+// ParseMessageID splits a message ID made with MakeMessageID into the portal ID and remote message ID.
+func ParseMessageID(messageID networkid.MessageID) (networkid.PortalID, string, error) {
+	rawPortalID, rawRemoteID, ok := strings.Cut(string(messageID), ":")
+	if !ok || rawPortalID == "" || rawRemoteID == "" {
+		return "", "", fmt.Errorf("invalid message ID %q", messageID)
+	}
+	portalID, err := url.QueryUnescape(rawPortalID)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid portal ID in message ID %q: %w", messageID, err)
+	}
+	remoteID, err := url.QueryUnescape(rawRemoteID)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid remote ID in message ID %q: %w", messageID, err)
+	}
+	return networkid.PortalID(portalID), remoteID, nil
+}
+
+// MakePartID returns the part ID for the part at the given index of a remote message.
+// The first part uses an empty ID, which is what the bridge assumes for single-part messages.
+func MakePartID(index int) networkid.PartID {
+	if index == 0 {
+		return ""
+	}
+	return networkid.PartID(strconv.Itoa(index))
+}
+
+// ParsePartID returns the index of a part ID made with MakePartID. Only the canonical form is
+// accepted, so that each part has exactly one ID.
+func ParsePartID(partID networkid.PartID) (int, error) {
+	if partID == "" {
+		return 0, nil
+	}
+	index, err := strconv.Atoi(string(partID))
+	if err != nil || index <= 0 || strconv.Itoa(index) != string(partID) {
+		return 0, fmt.Errorf("invalid part ID %q", partID)
+	}
+	return index, nil
+}
+
+// MakeEmojiID returns the emoji ID for a remote reaction. The remote network allows each user
+// to react once per emoji, so together with the target message and the sender the emoji itself
+// identifies the reaction.
+func MakeEmojiID(emoji string) networkid.EmojiID {
+	return networkid.EmojiID(url.QueryEscape(emoji))
+}
+
+// ParseEmojiID returns the emoji of an emoji ID made with MakeEmojiID.
+func ParseEmojiID(emojiID networkid.EmojiID) (string, error) {
+	emoji, err := url.QueryUnescape(string(emojiID))
+	if err != nil {
+		return "", fmt.Errorf("invalid emoji ID %q: %w", emojiID, err)
+	}
+	return emoji, nil
+}
+
+// userLoginNamespace is the UUID namespace of login IDs.
+var userLoginNamespace = uuid.MustParse("f7a4f3e3-5d5a-4a9e-8d8a-3b0b9e8a1b2c")
+
+// NormalizeRemoteUserID returns the canonical form of a remote user ID. Usernames are case-insensitive on the
+// remote, so user IDs must be compared in this form.
+func NormalizeRemoteUserID(username string) networkid.UserID {
+	return networkid.UserID(strings.ToLower(username))
+}
+
+// MakeUserLoginID returns the ID of the login of a remote account. It's derived from the normalized user ID,
+// so the ID is the same no matter how the username was typed when logging in.
+func MakeUserLoginID(username string) networkid.UserLoginID {
+	return networkid.UserLoginID(uuid.NewSHA1(userLoginNamespace, []byte(NormalizeRemoteUserID(username))).String())
+}
+
+// MakeWelcomePortalID returns the ID of the welcome portal of a login.
+// Welcome portals only exist on Matrix, so the ID includes the login ID to make it unique per login.
+func MakeWelcomePortalID(loginID networkid.UserLoginID) networkid.PortalID {
+	return networkid.PortalID("welcome:" + string(loginID))
+}
+
+// Direct media IDs contain everything needed to find a remote attachment again when it's downloaded through the
+// bridge: the login that received it, and the chat, message and attachment IDs on the remote.
+// The format is `<login ID>:<chat ID>:<remote message ID>:<attachment ID>` with all components query-escaped.
+
+// MediaRef is the remote file reference encoded in a direct media ID.
+type MediaRef struct {
+	LoginID      networkid.UserLoginID
+	ChatID       networkid.PortalID
+	MessageID    string
+	AttachmentID string
+}
+
+// MakeMediaID returns the direct media ID of a remote attachment.
+func MakeMediaID(ref MediaRef) networkid.MediaID {
+	return networkid.MediaID(strings.Join([]string{
+		url.QueryEscape(string(ref.LoginID)),
+		url.QueryEscape(string(ref.ChatID)),
+		url.QueryEscape(ref.MessageID),
+		url.QueryEscape(ref.AttachmentID),
+	}, ":"))
+}
+
+// ParseMediaID parses a media ID made with MakeMediaID.
+func ParseMediaID(mediaID networkid.MediaID) (*MediaRef, error) {
+	parts := strings.Split(string(mediaID), ":")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("invalid media ID %q", mediaID)
+	}
+	for i, part := range parts {
+		unescaped, err := url.QueryUnescape(part)
+		if err != nil || unescaped == "" {
+			return nil, fmt.Errorf("invalid media ID %q", mediaID)
+		}
+		parts[i] = unescaped
+	}
+	return &MediaRef{
+		LoginID:      networkid.UserLoginID(parts[0]),
+		ChatID:       networkid.PortalID(parts[1]),
+		MessageID:    parts[2],
+		AttachmentID: parts[3],
+	}, nil
+}
@@ -0,0 +1,100 @@
+package connector
+
+import (
+	"testing"
+
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+func TestMessageIDRoundTrip(t *testing.T) {
+	tests := []struct {
+		portalID networkid.PortalID
+		remoteID string
+	}{
+		{"chat1", "msg1"},
+		{"group:team", "msg:42"},
+		{"chat%20one", "100%"},
+		{"a:b%3Ac", "%3A:%"},
+		{"chat with spaces", "msg+plus&amp"},
+		{"🐈", "ünïcödé"},
+	}
+	for _, test := range tests {
+		messageID := MakeMessageID(test.portalID, test.remoteID)
+		portalID, remoteID, err := ParseMessageID(messageID)
+		if err != nil {
+			t.Errorf("ParseMessageID(%q) returned error: %v", messageID, err)
+		} else if portalID != test.portalID || remoteID != test.remoteID {
+			t.Errorf("message ID %q parsed as (%q, %q), expected (%q, %q)",
+				messageID, portalID, remoteID, test.portalID, test.remoteID)
+		}
+	}
+}
+
+func TestParseMessageIDInvalid(t *testing.T) {
+	for _, messageID := range []networkid.MessageID{"", "nocolon", ":msg", "chat:", "chat%zz:msg", "chat:msg%"} {
+		if _, _, err := ParseMessageID(messageID); err == nil {
+			t.Errorf("ParseMessageID(%q) should have failed", messageID)
+		}
+	}
+}
+
+func TestPartIDRoundTrip(t *testing.T) {
+	for _, index := range []int{0, 1, 2, 10, 123} {
+		partID := MakePartID(index)
+		parsed, err := ParsePartID(partID)
+		if err != nil {
+			t.Errorf("ParsePartID(%q) returned error: %v", partID, err)
+		} else if parsed != index {
+			t.Errorf("part ID %q parsed as %d, expected %d", partID, parsed, index)
+		}
+	}
+	if partID := MakePartID(0); partID != "" {
+		t.Errorf("the first part should have an empty ID, got %q", partID)
+	}
+}
+
+func TestParsePartIDInvalid(t *testing.T) {
+	for _, partID := range []networkid.PartID{"0", "-1", "one", "1:2", "%31", "01", "+1", " 1"} {
+		if _, err := ParsePartID(partID); err == nil {
+			t.Errorf("ParsePartID(%q) should have failed", partID)
+		}
+	}
+}
+
+func TestEmojiIDRoundTrip(t *testing.T) {
+	for _, emoji := range []string{"👍", "❤️", ":custom:", "100%", "a b+c"} {
+		emojiID := MakeEmojiID(emoji)
+		parsed, err := ParseEmojiID(emojiID)
+		if err != nil {
+			t.Errorf("ParseEmojiID(%q) returned error: %v", emojiID, err)
+		} else if parsed != emoji {
+			t.Errorf("emoji ID %q parsed as %q, expected %q", emojiID, parsed, emoji)
+		}
+	}
+}
+
+func TestMediaIDRoundTrip(t *testing.T) {
+	tests := []MediaRef{
+		{LoginID: "login", ChatID: "chat", MessageID: "msg", AttachmentID: "att"},
+		{LoginID: "f7a4f3e3-5d5a-4a9e-8d8a-3b0b9e8a1b2c", ChatID: "group:team", MessageID: "msg:1:2", AttachmentID: "file:a"},
+		{LoginID: "login%", ChatID: "chat%3A", MessageID: "50%:off", AttachmentID: "%%"},
+		{LoginID: "login", ChatID: "chat with spaces", MessageID: "msg+1", AttachmentID: "photo.jpg?size=large"},
+	}
+	for _, test := range tests {
+		mediaID := MakeMediaID(test)
+		parsed, err := ParseMediaID(mediaID)
+		if err != nil {
+			t.Errorf("ParseMediaID(%q) returned error: %v", mediaID, err)
+		} else if *parsed != test {
+			t.Errorf("media ID %q parsed as %+v, expected %+v", mediaID, *parsed, test)
+		}
+	}
+}
+
+func TestParseMediaIDInvalid(t *testing.T) {
+	for _, mediaID := range []string{"", "a:b:c", "a:b:c:d:e", "a::c:d", "a:b:c%zz:d"} {
+		if _, err := ParseMediaID(networkid.MediaID(mediaID)); err == nil {
+			t.Errorf("ParseMediaID(%q) should have failed", mediaID)
+		}
+	}
+}
@@ -5,11 +5,9 @@ import (
 	"fmt"
 	"strings"
 
-	"github.com/google/uuid"
 	"github.com/rs/zerolog"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/database"
-	"maunium.net/go/mautrix/bridgev2/networkid"
 	"maunium.net/go/mautrix/bridgev2/status"
 )
 
@@ -65,37 +63,65 @@ func (sl *SimpleLogin) SubmitUserInput(ctx context.Context, input map[string]str
 
 	sl.Log.Info().Str("username", username).Msg("Received login credentials (no actual validation performed)")
 
-	namespace := uuid.MustParse("f7a4f3e3-5d5a-4a9e-8d8a-3b0b9e8a1b2c")
-	loginIDStr := uuid.NewSHA1(namespace, []byte(strings.ToLower(username))).String()
-	var loginID networkid.UserLoginID = networkid.UserLoginID(loginIDStr)
+	loginID := MakeUserLoginID(username)
+
+	// The login ID is derived from the username, so logging in to the same account again finds the existing
+	// login. NewLogin then updates it in place, which keeps its portals, ghosts and space.
+	// Logging in to a different account adds a new login next to the existing ones.
+	var existing *bridgev2.UserLogin
+	var otherAccounts []string
+	for _, other := range sl.User.GetUserLogins() {
+		if other.ID == loginID {
+			existing = other
+		} else {
+			otherAccounts = append(otherAccounts, other.RemoteName)
+		}
+	}
 
+	// The client of an existing login keeps running while NewLogin merges the new session into its metadata
+	// and saves it, so that has to happen under the client's metadata lock.
+	unlockMetadata := lockLoginMetadata(existing)
 	ul, err := sl.User.NewLogin(ctx, &database.UserLogin{
 		ID:         loginID,
 		RemoteName: username,
 		RemoteProfile: status.RemoteProfile{
 			Name: username,
 		},
+		// The remote name keeps the casing of the username as typed, the user ID is what's compared.
+		Metadata: &LoginMetadata{
+			RemoteUserID: string(NormalizeRemoteUserID(username)),
+		},
 	}, &bridgev2.NewLoginParams{
 		DeleteOnConflict: false,
+		LoadUserLogin:    sl.loadUserLogin,
 	})
+	unlockMetadata()
 	if err != nil {
 		sl.Log.Err(err).Msg("Failed to create user login entry")
 		return nil, fmt.Errorf("failed to create user login: %w", err)
 	}
 
-	sl.Log.Info().Str("login_id", string(ul.ID)).Msg("Successfully 'logged in' and created user login")
-
-	err = sl.Main.LoadUserLogin(ctx, ul)
-	if err != nil {
-		sl.Log.Err(err).Msg("Failed to load user login after creation (this might indicate an issue)")
+	instructions := fmt.Sprintf("Successfully logged in as '%s'", username)
+	if existing != nil {
+		sl.Log.Info().Str("login_id", string(ul.ID)).Msg("Successfully re-authenticated existing user login")
+		instructions = fmt.Sprintf("Successfully re-authenticated as '%s'", username)
+	} else if len(otherAccounts) > 0 {
+		sl.Log.Info().Str("login_id", string(ul.ID)).Msg("Successfully added another user login")
+		instructions = fmt.Sprintf("Successfully logged in as '%s'. This is a different account than '%s', so it was added "+
+			"as a separate login with its own chats and space. Log out of the other account if you meant to replace it.",
+			username, strings.Join(otherAccounts, "', '"))
+	} else {
+		sl.Log.Info().Str("login_id", string(ul.ID)).Msg("Successfully 'logged in' and created user login")
 	}
 
-	go sl.Main.createWelcomeRoomAndSendIntro(ul)
+	// The bridge only connects logins on startup, so new and re-authenticated logins are connected here.
+	// Connect also onboards the login.
+	go ul.Client.Connect(ul.Log.WithContext(context.Background()))
 
 	return &bridgev2.LoginStep{
 		Type:         bridgev2.LoginStepTypeComplete,
 		StepID:       LoginStepIDComplete,
-		Instructions: fmt.Sprintf("Successfully logged in as '%s'", username),
+		Instructions: instructions,
 		CompleteParams: &bridgev2.LoginCompleteParams{
 			UserLoginID: ul.ID,
 			UserLogin:   ul,
@@ -103,6 +129,30 @@ func (sl *SimpleLogin) SubmitUserInput(ctx context.Context, input map[string]str
 	}, nil
 }
 
+// loadUserLogin is the LoadUserLogin function passed to NewLogin. When an existing login is logged in again,
+// its client is kept, as it reads the credentials from the login metadata that NewLogin has just updated.
+// Creating a new client would leave the outbox of the old one running.
+func (sl *SimpleLogin) loadUserLogin(ctx context.Context, ul *bridgev2.UserLogin) error {
+	if _, ok := ul.Client.(*MyNetworkClient); ok {
+		return nil
+	}
+	return sl.Main.LoadUserLogin(ctx, ul)
+}
+
+// lockLoginMetadata locks the metadata of the given login if it has a running client and returns the function
+// that unlocks it. The login may be nil.
+func lockLoginMetadata(ul *bridgev2.UserLogin) (unlock func()) {
+	if ul == nil {
+		return func() {}
+	}
+	nc, ok := ul.Client.(*MyNetworkClient)
+	if !ok {
+		return func() {}
+	}
+	nc.metaLock.Lock()
+	return nc.metaLock.Unlock
+}
+
 // Cancel implements bridgev2.LoginProcessUserInput.
 func (sl *SimpleLogin) Cancel() {
 	sl.Log.Debug().Msg("Login process cancelled")
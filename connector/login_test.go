@@ -0,0 +1,53 @@
+package connector
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mau.fi/util/ptr"
+)
+
+// TestReloginMergeHoldsMetadataLock does what NewLogin does when logging in again to an existing login while
+// its client keeps updating the metadata. Run with -race to check that the merge is synchronized.
+func TestReloginMergeHoldsMetadataLock(t *testing.T) {
+	nc := newTestClient(t, NetworkConfig{}, nil)
+	ctx := context.Background()
+	syncedAt := time.Now().Truncate(time.Second)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			err := nc.updateMetadata(ctx, func(meta *LoginMetadata) {
+				meta.LastSyncAt = ptr.Ptr(syncedAt)
+			})
+			if err != nil {
+				t.Errorf("failed to update metadata: %v", err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		unlock := lockLoginMetadata(nc.login)
+		nc.login.Metadata.(*LoginMetadata).CopyFrom(&LoginMetadata{RemoteUserID: "alice", AccessToken: "new-token"})
+		err := nc.login.Save(ctx)
+		unlock()
+		if err != nil {
+			t.Fatalf("failed to save merged login: %v", err)
+		}
+	}
+	wg.Wait()
+
+	saved := savedMetadata(t, nc)
+	if saved.AccessToken != "new-token" {
+		t.Errorf("expected the new access token to be saved, got %q", saved.AccessToken)
+	}
+	if saved.LastSyncAt == nil || !saved.LastSyncAt.Equal(syncedAt) {
+		t.Errorf("expected the last sync time to be kept, got %v", saved.LastSyncAt)
+	}
+	// A first login has no client to lock.
+	lockLoginMetadata(nil)()
+}
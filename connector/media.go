@@ -0,0 +1,138 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/mediaproxy"
+)
+
+// attachmentURLMinValidity is how long an attachment URL must still be valid to be used. The media proxy tells
+// clients to cache redirects until 5 minutes before the URL expires, so URLs that expire sooner are refreshed.
+const attachmentURLMinValidity = 10 * time.Minute
+
+// Ensure MyConnector implements DirectMediableNetwork.
+var _ bridgev2.DirectMediableNetwork = (*MyConnector)(nil)
+
+// SetUseDirectMedia implements bridgev2.DirectMediableNetwork. It's called before Start if direct_media is enabled
+// in the bridge config. Attachments then get mxc:// URIs that point back to the bridge instead of being reuploaded.
+func (c *MyConnector) SetUseDirectMedia() {
+	c.useDirectMedia = true
+}
+
+// Download implements bridgev2.DirectMediableNetwork. It's called when a client downloads a direct media URI.
+// The client is redirected to a fresh remote URL, which also lets the remote serve range requests for large files.
+func (c *MyConnector) Download(ctx context.Context, mediaID networkid.MediaID, params map[string]string) (mediaproxy.GetMediaResponse, error) {
+	ref, err := ParseMediaID(mediaID)
+	if err != nil {
+		return nil, mautrix.MNotFound.WithMessage("Invalid media ID")
+	}
+	login := c.bridge.GetCachedUserLoginByID(ref.LoginID)
+	if login == nil {
+		return nil, mautrix.MNotFound.WithMessage("The account that received this file isn't logged into the bridge anymore")
+	}
+	nc, ok := login.Client.(*MyNetworkClient)
+	if !ok || !nc.IsLoggedIn() {
+		return nil, mautrix.MNotFound.WithMessage("The account that received this file isn't logged into the bridge anymore")
+	}
+	attachmentURL, err := nc.getAttachmentURL(ctx, ref, nil)
+	if isNotFoundError(err) {
+		return nil, mautrix.MNotFound.WithMessage("The file was deleted from the remote network")
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get attachment URL: %w", err)
+	}
+	return &mediaproxy.GetMediaResponseURL{
+		URL:       attachmentURL.URL,
+		ExpiresAt: attachmentURL.ExpiresAt,
+	}, nil
+}
+
+// getAttachmentURL returns a download URL of an attachment that's valid for at least attachmentURLMinValidity.
+// The URL in the message is used if it's still valid, otherwise a new one is requested and cached until it expires.
+func (nc *MyNetworkClient) getAttachmentURL(ctx context.Context, ref *MediaRef, att *NetworkAttachment) (*AttachmentURL, error) {
+	if att != nil && att.URL != "" && isURLValid(att.URLExpiresAt) {
+		return &AttachmentURL{URL: att.URL, ExpiresAt: att.URLExpiresAt}, nil
+	}
+	cacheKey := string(MakeMediaID(*ref))
+	if cached, ok := nc.attachmentURLs.Load(cacheKey); ok && isURLValid(cached.(*AttachmentURL).ExpiresAt) {
+		return cached.(*AttachmentURL), nil
+	}
+	attachmentURL, err := nc.remote.GetAttachmentURL(ctx, &GetAttachmentURLRequest{
+		ChatID:       ref.ChatID,
+		MessageID:    ref.MessageID,
+		AttachmentID: ref.AttachmentID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	nc.attachmentURLs.Store(cacheKey, attachmentURL)
+	return attachmentURL, nil
+}
+
+func isURLValid(expiresAt time.Time) bool {
+	return expiresAt.IsZero() || time.Until(expiresAt) > attachmentURLMinValidity
+}
+
+// convertAttachment converts a remote attachment into a Matrix media message. With direct media, the content
+// points to the bridge's media endpoint. Otherwise, the file is downloaded and reuploaded to Matrix.
+func (nc *MyNetworkClient) convertAttachment(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, msg *NetworkMessage, att *NetworkAttachment) (*event.MessageEventContent, error) {
+	content := &event.MessageEventContent{
+		MsgType: attachmentMsgType(att.MimeType),
+		Body:    att.FileName,
+		Info: &event.FileInfo{
+			MimeType: att.MimeType,
+			Size:     int(att.Size),
+			Width:    att.Width,
+			Height:   att.Height,
+		},
+	}
+	if content.Body == "" {
+		content.Body = att.ID
+	}
+	ref := &MediaRef{LoginID: nc.login.ID, ChatID: msg.ChatID, MessageID: msg.ID, AttachmentID: att.ID}
+	if nc.connector.useDirectMedia {
+		mxc, err := nc.bridge.Matrix.GenerateContentURI(ctx, MakeMediaID(*ref))
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate content URI: %w", err)
+		}
+		content.URL = mxc
+		return content, nil
+	}
+	attachmentURL, err := nc.getAttachmentURL(ctx, ref, att)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attachment URL: %w", err)
+	}
+	data, err := nc.remote.Download(ctx, attachmentURL.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download attachment: %w", err)
+	}
+	if intent == nil {
+		// Backfilled messages are converted before their sender is known.
+		intent = nc.bridge.Bot
+	}
+	content.URL, content.File, err = intent.UploadMedia(ctx, portal.MXID, data, content.Body, att.MimeType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload attachment: %w", err)
+	}
+	content.Info.Size = len(data)
+	return content, nil
+}
+
+func attachmentMsgType(mimeType string) event.MessageType {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return event.MsgImage
+	case strings.HasPrefix(mimeType, "video/"):
+		return event.MsgVideo
+	case strings.HasPrefix(mimeType, "audio/"):
+		return event.MsgAudio
+	default:
+		return event.MsgFile
+	}
+}
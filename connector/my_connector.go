@@ -3,16 +3,15 @@ package connector
 import (
 	"context"
 	"fmt"
-	"math/rand"
-	"time"
+	"sync"
 
+	"github.com/google/uuid"
 	"github.com/rs/zerolog"
-	"go.mau.fi/util/configupgrade"
-	"go.mau.fi/util/ptr"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/database"
 	"maunium.net/go/mautrix/bridgev2/networkid"
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
 // Ensure MyConnector implements NetworkConnector.
@@ -22,6 +21,21 @@ var _ bridgev2.NetworkConnector = (*MyConnector)(nil)
 type MyConnector struct {
 	log    zerolog.Logger
 	bridge *bridgev2.Bridge
+
+	// Config is the network section of the bridge config. It's filled by the bridge before Init is called
+	// and shared with every MyNetworkClient through their connector field.
+	Config NetworkConfig
+
+	// onboarding contains the IDs of logins whose welcome room is currently being created.
+	onboarding sync.Map
+
+	// ghostPresence throttles presence updates of ghosts by remote user ID, userPresence those sent to the
+	// remote by login ID.
+	ghostPresence *presenceThrottle
+	userPresence  *presenceThrottle
+
+	// useDirectMedia is set by SetUseDirectMedia if direct_media is enabled in the bridge config.
+	useDirectMedia bool
 }
 
 // NewMyConnector creates a new instance of MyConnector.
@@ -35,6 +49,10 @@ func NewMyConnector(log zerolog.Logger) *MyConnector {
 func (c *MyConnector) Init(br *bridgev2.Bridge) {
 	c.bridge = br
 	c.log = c.bridge.Log
+	c.ghostPresence = newPresenceThrottle(c.Config.Presence.MinInterval)
+	c.userPresence = newPresenceThrottle(c.Config.Presence.MinInterval)
+	c.registerCommands()
+	c.registerPresenceHandler()
 	c.log.Info().Msg("MyConnector Init called")
 }
 
@@ -56,11 +74,6 @@ func (c *MyConnector) GetNetworkID() string {
 	return c.GetName().NetworkID
 }
 
-// GetCapabilities implements bridgev2.NetworkConnector.
-func (c *MyConnector) GetCapabilities() *bridgev2.NetworkGeneralCapabilities {
-	return &bridgev2.NetworkGeneralCapabilities{}
-}
-
 // GetDBMetaTypes implements bridgev2.NetworkConnector.
 func (c *MyConnector) GetDBMetaTypes() database.MetaTypes {
 	return database.MetaTypes{
@@ -97,19 +110,32 @@ func (c *MyConnector) CreateLogin(ctx context.Context, user *bridgev2.User, flow
 	}, nil
 }
 
-// GetConfig implements bridgev2.NetworkConnector.
-func (c *MyConnector) GetConfig() (string, any, configupgrade.Upgrader) {
-	return "simple-config.yaml", nil, nil
+// Ensure MyConnector implements TransactionIDGeneratingNetwork.
+var _ bridgev2.TransactionIDGeneratingNetwork = (*MyConnector)(nil)
+
+// GenerateTransactionID implements bridgev2.TransactionIDGeneratingNetwork.
+// The ID is sent to the remote with outgoing messages and comes back in the echo.
+func (c *MyConnector) GenerateTransactionID(userID id.UserID, roomID id.RoomID, eventType event.Type) networkid.RawTransactionID {
+	return networkid.RawTransactionID("mx-" + uuid.NewString())
 }
 
 // GetBridgeInfoVersion implements bridgev2.NetworkConnector.
 func (c *MyConnector) GetBridgeInfoVersion() (int, int) {
-	return 1, 0
+	return 1, capVersion
 }
 
 // Start implements bridgev2.NetworkConnector.
 func (c *MyConnector) Start(ctx context.Context) error {
 	c.log.Info().Msg("MyConnector Start called")
+	if !c.bridge.Config.SplitPortals {
+		c.log.Warn().Msg("bridge.split_portals is disabled: users with several logins get a single room for chats " +
+			"their accounts share. Enable it before the first login to give every login its own rooms.")
+		if c.Config.ContactNamesInDMs {
+			c.log.Warn().Msg("network.contact_names_in_dms has no effect without bridge.split_portals, " +
+				"as DM rooms are shared and the names would be visible to other users")
+		}
+	}
+	go c.rerenderGhostNames(context.WithoutCancel(ctx))
 	return nil
 }
 
@@ -132,7 +158,11 @@ func (c *MyConnector) LoadUserLogin(ctx context.Context, login *bridgev2.UserLog
 		bridge:    c.bridge,
 		login:     login,
 		connector: c,
+		dedup:     newEventDeduplicator(c.bridge, dedupCacheSize),
+		limiter:   newRateLimiter(c.Config.RateLimits),
 	}
+	client.remote = c.newRemoteAPI(client)
+	client.outbox = newOutbox(client)
 
 	login.Client = client
 
@@ -142,95 +172,5 @@ func (c *MyConnector) LoadUserLogin(ctx context.Context, login *bridgev2.UserLog
 		Interface("client_type", client).
 		Msg("Created and stored MyNetworkClient")
 
-	go c.createWelcomeRoomAndSendIntro(login)
-
 	return nil
 }
-
-// createWelcomeRoomAndSendIntro performs the room creation and ghost interaction logic.
-func (c *MyConnector) createWelcomeRoomAndSendIntro(login *bridgev2.UserLogin) {
-	ctx := context.Background()
-	user := login.User
-	log := c.log.With().Str("user_mxid", string(user.MXID)).Str("login_id", string(login.ID)).Logger()
-	ctx = log.WithContext(ctx)
-
-	rand.Seed(time.Now().UnixNano())
-
-	log.Info().Msg("Starting welcome room creation process")
-
-	portalID := networkid.PortalID("welcome-room")
-	portalKey := networkid.PortalKey{
-		ID: portalID,
-	}
-
-	portal, err := c.bridge.GetPortalByKey(ctx, portalKey)
-	if err != nil {
-		log.Err(err).Str("portal_key", string(portalKey.ID)).Msg("Failed to get portal")
-		return
-	}
-
-	log.Info().Str("portal_id", string(portal.ID)).Msg("Successfully retrieved portal")
-
-	ghostNetworkUserID := networkid.UserID(fmt.Sprintf("%s_ghosty_ghost", c.GetNetworkID()))
-	ghostDisplayName := "Ghosty Ghost"
-
-	ghost, err := c.bridge.GetGhostByID(ctx, ghostNetworkUserID)
-	if err != nil {
-		log.Err(err).Str("ghost_network_user_id", string(ghostNetworkUserID)).Msg("Failed to get ghost")
-		return
-	}
-
-	ghostInfo := &bridgev2.UserInfo{
-		Name: &ghostDisplayName,
-	}
-	ghost.UpdateInfo(ctx, ghostInfo)
-
-	log = log.With().Str("ghost_mxid", string(ghost.ID)).Logger()
-	log.Info().Msg("Successfully retrieved/provisioned ghost")
-
-	err = portal.CreateMatrixRoom(ctx, user.GetDefaultLogin(), &bridgev2.ChatInfo{
-		Name:  ptr.Ptr(fmt.Sprintf("Welcome %s!", login.RemoteName)),
-		Topic: ptr.Ptr("Your special welcome room."),
-		Members: &bridgev2.ChatMemberList{Members: []bridgev2.ChatMember{
-			{
-				EventSender: bridgev2.EventSender{
-					Sender:      networkid.UserID(user.MXID),
-					SenderLogin: networkid.UserLoginID(user.GetDefaultLogin().ID),
-				},
-				Membership: event.MembershipJoin,
-				Nickname:   ptr.Ptr(login.RemoteName),
-				PowerLevel: ptr.Ptr(100),
-				UserInfo: &bridgev2.UserInfo{
-					Name: ptr.Ptr(login.RemoteName),
-				},
-			},
-		}},
-	})
-	if err != nil {
-		log.Err(err).Msg("Failed to create matrix room")
-		return
-	}
-	log.Info().Msg("Successfully created matrix room")
-
-	err = ghost.Intent.EnsureJoined(ctx, portal.MXID)
-	if err != nil {
-		log.Err(err).Msg("Failed to ensure ghost was joined before sending message")
-		return
-	}
-
-	greetings := []string{"Hello there!", "Welcome!", "Greetings!", "Hi!", "Hey!"}
-	randomGreeting := greetings[rand.Intn(len(greetings))]
-	messageContent := &event.MessageEventContent{
-		MsgType: event.MsgText,
-		Body:    fmt.Sprintf("%s I'm %s, your friendly welcome bot for the %s bridge.", randomGreeting, ghostDisplayName, c.GetName().DisplayName),
-	}
-
-	content := &event.Content{Parsed: messageContent}
-
-	_, err = ghost.Intent.SendMessage(ctx, portal.MXID, event.EventMessage, content, nil)
-	if err != nil {
-		log.Err(err).Msg("Failed to send welcome message from ghost")
-		return
-	}
-	log.Info().Msg("Successfully sent welcome message from ghost")
-}
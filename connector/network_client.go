@@ -2,10 +2,16 @@ package connector
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
 
 	"github.com/rs/zerolog"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/status"
 )
 
 // Ensure MyNetworkClient implements NetworkAPI.
@@ -18,29 +24,193 @@ type MyNetworkClient struct {
 	bridge    *bridgev2.Bridge
 	login     *bridgev2.UserLogin
 	connector *MyConnector
+
+	dedup   *eventDeduplicator
+	remote  remoteAPI
+	limiter *rateLimiter
+	outbox  *outbox
+
+	// loggedOut is set by LogoutRemote. Remote events that arrive afterwards are dropped.
+	loggedOut atomic.Bool
+	// presenceUnsupported is set when the remote has rejected setting the online status.
+	presenceUnsupported atomic.Bool
+	// manualSyncRunning is set while a sync requested with the sync command in the system portal is running.
+	manualSyncRunning atomic.Bool
+	// attachmentURLs caches refreshed attachment URLs by media ID until they expire.
+	attachmentURLs sync.Map
+
+	// metaLock guards the login metadata, which is marshaled whenever the login is saved.
+	metaLock sync.Mutex
+
+	// pollLock guards stopPolling, which cancels the poller started by Connect. It's nil if the client isn't polling.
+	pollLock    sync.Mutex
+	stopPolling context.CancelFunc
+}
+
+// withMetadata calls fn with the login metadata locked, for reading it or changing it without saving.
+func (nc *MyNetworkClient) withMetadata(fn func(meta *LoginMetadata)) {
+	nc.metaLock.Lock()
+	defer nc.metaLock.Unlock()
+	fn(nc.login.Metadata.(*LoginMetadata))
 }
 
-// Connect is a no-op for this simple connector.
+// updateMetadata changes the login metadata and saves the login. Every save of the login goes through here,
+// so that a change like an outbox update can't happen while another save is marshaling the metadata.
+func (nc *MyNetworkClient) updateMetadata(ctx context.Context, fn func(meta *LoginMetadata)) error {
+	nc.metaLock.Lock()
+	defer nc.metaLock.Unlock()
+	fn(nc.login.Metadata.(*LoginMetadata))
+	return nc.login.Save(ctx)
+}
+
+// Connect checks the connection to the remote, starts sending messages that were queued while disconnected
+// and starts polling for new events if network.sync.poll_interval is set.
 func (nc *MyNetworkClient) Connect(ctx context.Context) {
-	nc.log.Info().Msg("MyNetworkClient Connect called (no-op)")
+	nc.log.Info().Msg("MyNetworkClient Connect called")
+	nc.checkConnection(ctx)
+	nc.outbox.Start()
+	nc.startPolling()
+	// Every login has its own space with its chats. The bridge creates it when the first portal is added,
+	// but creating it right away lets users with several accounts tell them apart before any chat is bridged.
+	_, err := nc.login.GetSpaceRoom(ctx)
+	if err != nil {
+		nc.log.Warn().Err(err).Msg("Failed to get space room")
+	}
+	if nc.connector.Config.Sync.ChatLimit > 0 {
+		go nc.syncChatsOnConnect(nc.log.WithContext(context.Background()))
+	}
+	// Onboarding is retried on every connect until it has succeeded once, which also covers logins that
+	// were created before it was enabled.
+	go nc.connector.onboardLogin(nc.login)
 }
 
-// Disconnect is a no-op for this simple connector.
+// Disconnect stops polling and sending queued messages. They stay in the outbox until the next Connect.
 func (nc *MyNetworkClient) Disconnect() {
-	nc.log.Info().Msg("MyNetworkClient Disconnect called (no-op)")
+	nc.log.Info().Msg("MyNetworkClient Disconnect called")
+	nc.outbox.Stop()
+	nc.pollLock.Lock()
+	if nc.stopPolling != nil {
+		nc.stopPolling()
+		nc.stopPolling = nil
+	}
+	nc.pollLock.Unlock()
 }
 
-// LogoutRemote is a no-op for this simple connector.
+// checkConnection fetches the user's own profile to check that the remote can be reached with the login's
+// credentials, and sets the bridge state accordingly. It gives up after network.connect_timeout.
+func (nc *MyNetworkClient) checkConnection(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, nc.connector.Config.ConnectTimeout)
+	defer cancel()
+	_, err := nc.remote.GetUser(ctx, nc.remoteUserID())
+	var remoteErr *RemoteError
+	if errors.As(err, &remoteErr) && remoteErr.StatusCode == http.StatusUnauthorized {
+		nc.log.Warn().Err(err).Msg("Remote network rejected the credentials")
+		nc.login.BridgeState.Send(status.BridgeState{
+			StateEvent: status.StateBadCredentials,
+			Error:      "simplenetwork-unauthorized",
+			Message:    "The remote network rejected the login, please log in again",
+		})
+	} else if err != nil {
+		nc.log.Warn().Err(err).Msg("Failed to connect to remote network")
+		nc.login.BridgeState.Send(status.BridgeState{
+			StateEvent: status.StateTransientDisconnect,
+			Error:      "simplenetwork-connect-failed",
+			Message:    fmt.Sprintf("Failed to connect: %v", err),
+		})
+	} else {
+		nc.login.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnected})
+	}
+}
+
+// startPolling starts polling the remote event feed in the background, unless it's disabled or already running.
+func (nc *MyNetworkClient) startPolling() {
+	if nc.connector.Config.Sync.PollInterval <= 0 {
+		return
+	}
+	nc.pollLock.Lock()
+	defer nc.pollLock.Unlock()
+	if nc.stopPolling != nil {
+		return
+	}
+	var ctx context.Context
+	ctx, nc.stopPolling = context.WithCancel(nc.log.With().Str("component", "poller").Logger().WithContext(context.Background()))
+	go nc.pollEvents(ctx)
+}
+
+// LogoutRemote revokes the session on the remote network and removes the credentials from the login metadata.
+// If the remote can't be reached, the session is only forgotten locally, so logging out never fails.
 func (nc *MyNetworkClient) LogoutRemote(ctx context.Context) {
-	nc.log.Info().Msg("MyNetworkClient LogoutRemote called (no-op)")
+	log := nc.log.With().Str("action", "logout remote").Logger()
+	ctx = log.WithContext(ctx)
+	nc.loggedOut.Store(true)
+	nc.Disconnect()
+
+	var deviceID string
+	nc.withMetadata(func(meta *LoginMetadata) {
+		deviceID = meta.DeviceID
+	})
+	err := nc.remote.Logout(ctx, &LogoutRequest{DeviceID: deviceID})
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to revoke remote session, only logging out locally")
+	} else {
+		log.Info().Msg("Revoked remote session")
+	}
+	err = nc.updateMetadata(ctx, (*LoginMetadata).clearCredentials)
+	if err != nil {
+		log.Err(err).Msg("Failed to save login after clearing credentials")
+	}
+	nc.login.BridgeState.Send(status.BridgeState{StateEvent: status.StateLoggedOut})
+}
+
+// remoteUserID returns the normalized remote network user ID of this login.
+func (nc *MyNetworkClient) remoteUserID() networkid.UserID {
+	return loginRemoteUserID(nc.login)
+}
+
+// loginRemoteUserID returns the normalized remote user ID of a login. The remote name can't be used directly,
+// as it keeps the casing the username was typed in at the last login. Logins from before the user ID was
+// stored in the metadata fall back to the normalized remote name.
+func loginRemoteUserID(login *bridgev2.UserLogin) networkid.UserID {
+	if meta, ok := login.Metadata.(*LoginMetadata); ok && meta.RemoteUserID != "" {
+		return networkid.UserID(meta.RemoteUserID)
+	}
+	return NormalizeRemoteUserID(login.RemoteName)
+}
+
+// makePortalKey returns the key of the portal of a remote chat. If split_portals is enabled in the bridge config,
+// every login gets its own portal, so two accounts of the same Matrix user that share a chat get separate rooms.
+func (nc *MyNetworkClient) makePortalKey(chatID networkid.PortalID) networkid.PortalKey {
+	key := networkid.PortalKey{ID: chatID}
+	if nc.bridge.Config.SplitPortals {
+		key.Receiver = nc.login.ID
+	}
+	return key
+}
+
+// makeEventSender returns the event sender for a remote user, attributing it to this login if it's the user themselves.
+// Other remote accounts that are logged into the bridge are attributed to their own login, so that their events
+// are sent by the double puppet of the right Matrix user in shared portals.
+func (nc *MyNetworkClient) makeEventSender(ctx context.Context, userID networkid.UserID) bridgev2.EventSender {
+	if nc.IsThisUser(ctx, userID) {
+		return bridgev2.EventSender{
+			IsFromMe:    true,
+			SenderLogin: nc.login.ID,
+			Sender:      userID,
+		}
+	}
+	sender := bridgev2.EventSender{Sender: userID}
+	if login := nc.bridge.GetCachedUserLoginByID(MakeUserLoginID(string(userID))); login != nil {
+		sender.SenderLogin = login.ID
+	}
+	return sender
 }
 
 // IsThisUser checks if the given remote network user ID belongs to this client instance.
 func (nc *MyNetworkClient) IsThisUser(ctx context.Context, userID networkid.UserID) bool {
-	return string(userID) == nc.login.RemoteName
+	return NormalizeRemoteUserID(string(userID)) == nc.remoteUserID()
 }
 
-// IsLoggedIn always returns true for this simple connector.
+// IsLoggedIn returns true until the login is logged out with LogoutRemote.
 func (nc *MyNetworkClient) IsLoggedIn() bool {
-	return true
+	return !nc.loggedOut.Load()
 }
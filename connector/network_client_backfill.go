@@ -2,13 +2,22 @@ package connector
 
 import (
 	"context"
-	"time"
+	"fmt"
+	"slices"
 
 	"maunium.net/go/mautrix/bridgev2"
-	"maunium.net/go/mautrix/bridgev2/networkid"
-	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/bridgev2/database"
 )
 
+// backfillCount is the number of messages requested with the backfill command. It's passed from the
+// command to FetchMessages as the bundled backfill data of a chat resync.
+type backfillCount int
+
+// alwaysBackfill makes a chat resync trigger a forward backfill regardless of the latest message.
+func alwaysBackfill(ctx context.Context, latestMessage *database.Message) (bool, error) {
+	return true, nil
+}
+
 // BackfillingNetworkAPI is responsible for loading historic messages
 var _ bridgev2.BackfillingNetworkAPI = (*MyNetworkClient)(nil)
 
@@ -16,7 +25,6 @@ var _ bridgev2.BackfillingNetworkAPI = (*MyNetworkClient)(nil)
 // This wil get called when the user opens a room and wants to load historical messages
 func (nc *MyNetworkClient) FetchMessages(ctx context.Context, fetchParams bridgev2.FetchMessagesParams) (*bridgev2.FetchMessagesResponse, error) {
 	portal := fetchParams.Portal
-	now := time.Now().UTC()
 
 	log := nc.log.With().
 		Str("portal_id", string(portal.ID)).
@@ -26,63 +34,49 @@ func (nc *MyNetworkClient) FetchMessages(ctx context.Context, fetchParams bridge
 	ctx = log.WithContext(ctx)
 	log.Info().Msg("FetchMessages called")
 
-	backfillMsg1 := &bridgev2.BackfillMessage{
-		ID:        networkid.MessageID("static-backfill-1-" + string(portal.ID)),
-		Timestamp: now.Add(-3 * time.Minute),
-		Sender: bridgev2.EventSender{
-			Sender:   networkid.UserID("example-ghost"),
-			IsFromMe: false,
-		},
-		ConvertedMessage: &bridgev2.ConvertedMessage{
-			Parts: []*bridgev2.ConvertedMessagePart{{
-				Type: event.EventMessage,
-				Content: &event.MessageEventContent{
-					MsgType: event.MsgText,
-					Body:    "Backfilled history (placeholder) #1.",
-				},
-			}},
-		},
+	req := &GetHistoryRequest{
+		ChatID: portal.ID,
+		Limit:  nc.connector.Config.Sync.BackfillBatchSize,
 	}
-
-	backfillMsg2 := &bridgev2.BackfillMessage{
-		ID:        networkid.MessageID("static-backfill-2-" + string(portal.ID)),
-		Timestamp: now.Add(-2 * time.Minute),
-		Sender: bridgev2.EventSender{
-			Sender:   networkid.UserID("example-ghost"),
-			IsFromMe: false,
-		},
-		ConvertedMessage: &bridgev2.ConvertedMessage{
-			Parts: []*bridgev2.ConvertedMessagePart{{
-				Type: event.EventMessage,
-				Content: &event.MessageEventContent{
-					MsgType: event.MsgText,
-					Body:    "Backfilled history (placeholder) #2.",
-				},
-			}},
-		},
+	if count, ok := fetchParams.BundledData.(backfillCount); ok {
+		// Backfills requested with the backfill command aren't limited by the batch size.
+		req.Limit = int(count)
+	} else if fetchParams.Count > 0 {
+		req.Limit = min(req.Limit, fetchParams.Count)
+	}
+	// The remote only pages backwards. Forward fetches get the newest messages,
+	// and anything already bridged is dropped by the bridge's deduplication.
+	if !fetchParams.Forward && fetchParams.AnchorMessage != nil {
+		_, remoteID, err := ParseMessageID(fetchParams.AnchorMessage.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse anchor message ID: %w", err)
+		}
+		req.BeforeID = remoteID
+	}
+	history, err := nc.remote.GetHistory(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch history: %w", err)
 	}
 
-	backfillMsg3 := &bridgev2.BackfillMessage{
-		ID:        networkid.MessageID("static-backfill-3-" + string(portal.ID)),
-		Timestamp: now.Add(-1 * time.Minute),
-		Sender: bridgev2.EventSender{
-			Sender:   networkid.UserID("example-ghost"),
-			IsFromMe: false,
-		},
-		ConvertedMessage: &bridgev2.ConvertedMessage{
-			Parts: []*bridgev2.ConvertedMessagePart{{
-				Type: event.EventMessage,
-				Content: &event.MessageEventContent{
-					MsgType: event.MsgText,
-					Body:    "Backfilled history (placeholder) #3.",
-				},
-			}},
-		},
+	// The remote returns the newest message first, the bridge wants them in chronological order.
+	messages := make([]*bridgev2.BackfillMessage, 0, len(history.Messages))
+	for _, msg := range slices.Backward(history.Messages) {
+		converted, err := nc.convertNetworkMessage(ctx, portal, nil, msg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert message %s: %w", msg.ID, err)
+		}
+		messages = append(messages, &bridgev2.BackfillMessage{
+			ConvertedMessage: converted,
+			ID:               MakeMessageID(msg.ChatID, msg.ID),
+			TxnID:            msg.TransactionID,
+			Timestamp:        msg.Timestamp,
+			Sender:           nc.makeEventSender(ctx, msg.SenderID),
+		})
 	}
 
 	return &bridgev2.FetchMessagesResponse{
-		Messages:                []*bridgev2.BackfillMessage{backfillMsg1, backfillMsg2, backfillMsg3},
-		HasMore:                 false,
+		Messages:                messages,
+		HasMore:                 history.HasMore,
 		Forward:                 fetchParams.Forward,
 		MarkRead:                !fetchParams.Forward,
 		AggressiveDeduplication: true,
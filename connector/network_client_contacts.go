@@ -0,0 +1,168 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+)
+
+// ContactListingNetworkAPI and UserSearchingNetworkAPI expose the remote contact list
+// and user directory through the provisioning API.
+var (
+	_ bridgev2.ContactListingNetworkAPI = (*MyNetworkClient)(nil)
+	_ bridgev2.UserSearchingNetworkAPI  = (*MyNetworkClient)(nil)
+)
+
+// GetContactList implements [bridgev2.ContactListingNetworkAPI].
+func (nc *MyNetworkClient) GetContactList(ctx context.Context) ([]*bridgev2.ResolveIdentifierResponse, error) {
+	contacts, err := nc.remote.GetContacts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get contacts: %w", err)
+	}
+	resp := make([]*bridgev2.ResolveIdentifierResponse, 0, len(contacts))
+	contactNames := make(map[networkid.UserID]string)
+	for _, contact := range contacts {
+		if contact.ContactName != "" {
+			contactNames[contact.ID] = contact.ContactName
+		}
+		resolved, err := nc.resolveNetworkUser(ctx, &contact.NetworkUser)
+		if err != nil {
+			return nil, err
+		}
+		// The bridge doesn't sync ghost info for contact lists, but the response includes the
+		// ghost's name and avatar, so make sure they're up to date.
+		if resolved.Ghost.Name == "" || resolved.Ghost.AvatarID != resolved.UserInfo.Avatar.ID {
+			resolved.Ghost.UpdateInfo(ctx, resolved.UserInfo)
+		}
+		resp = append(resp, resolved)
+	}
+	nc.updateContactNames(ctx, contactNames)
+	return resp, nil
+}
+
+// SearchUsers implements [bridgev2.UserSearchingNetworkAPI].
+func (nc *MyNetworkClient) SearchUsers(ctx context.Context, query string) ([]*bridgev2.ResolveIdentifierResponse, error) {
+	users, err := nc.remote.SearchUsers(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search users: %w", err)
+	}
+	resp := make([]*bridgev2.ResolveIdentifierResponse, 0, len(users))
+	for _, user := range users {
+		resolved, err := nc.resolveNetworkUser(ctx, user)
+		if err != nil {
+			return nil, err
+		}
+		resp = append(resp, resolved)
+	}
+	return resp, nil
+}
+
+// updateContactNames stores the user's contact names and, if network.contact_names_in_dms is enabled,
+// applies changed names to the DM rooms with those contacts.
+func (nc *MyNetworkClient) updateContactNames(ctx context.Context, contactNames map[networkid.UserID]string) {
+	var oldNames map[networkid.UserID]string
+	nc.withMetadata(func(meta *LoginMetadata) {
+		oldNames = meta.ContactNames
+	})
+	if maps.Equal(oldNames, contactNames) {
+		return
+	}
+	err := nc.updateMetadata(ctx, func(meta *LoginMetadata) {
+		meta.ContactNames = contactNames
+	})
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to save contact names")
+	}
+	if !nc.connector.Config.ContactNamesInDMs {
+		return
+	}
+	for userID := range maps.Keys(contactNames) {
+		if oldNames[userID] != contactNames[userID] {
+			nc.applyContactName(ctx, userID, contactNames[userID])
+		}
+	}
+	for userID := range maps.Keys(oldNames) {
+		if _, stillExists := contactNames[userID]; !stillExists {
+			nc.applyContactName(ctx, userID, "")
+		}
+	}
+}
+
+// applyContactName sets the ghost's displayname in this login's DM rooms with it to the contact name.
+// Matrix has no per-user displaynames, so the per-room member event is the closest equivalent. It's only
+// set in portals of this login: without split portals, a DM room is shared by every login in the chat,
+// so the other users in it would see the name too. If the name is empty, the ghost's normal name is restored.
+func (nc *MyNetworkClient) applyContactName(ctx context.Context, userID networkid.UserID, name string) {
+	log := zerolog.Ctx(ctx).With().Str("contact_id", string(userID)).Logger()
+	portals, err := nc.bridge.GetDMPortalsWith(ctx, userID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get DM portals to apply contact name")
+		return
+	}
+	ghost, err := nc.bridge.GetGhostByID(ctx, userID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get ghost to apply contact name")
+		return
+	}
+	if name == "" {
+		name = ghost.Name
+	}
+	for _, portal := range portals {
+		if portal.MXID != "" && portal.Receiver == nc.login.ID {
+			setMemberName(ctx, portal, ghost, name)
+		}
+	}
+}
+
+// reapplyContactNames sets the contact names of a ghost in the DM rooms of every login again. Updating the
+// profile of a ghost replaces its member events in all rooms, so it's called after the profile has changed.
+func (c *MyConnector) reapplyContactNames(ctx context.Context, ghost *bridgev2.Ghost) {
+	if !c.Config.ContactNamesInDMs || !c.bridge.Config.SplitPortals {
+		return
+	}
+	portals, err := c.bridge.GetDMPortalsWith(ctx, ghost.ID)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Str("contact_id", string(ghost.ID)).Msg("Failed to get DM portals to reapply contact names")
+		return
+	}
+	for _, portal := range portals {
+		login := c.bridge.GetCachedUserLoginByID(portal.Receiver)
+		if portal.MXID == "" || login == nil {
+			continue
+		}
+		nc, ok := login.Client.(*MyNetworkClient)
+		if !ok {
+			continue
+		}
+		var name string
+		nc.withMetadata(func(meta *LoginMetadata) {
+			name = meta.ContactNames[ghost.ID]
+		})
+		if name != "" {
+			setMemberName(ctx, portal, ghost, name)
+		}
+	}
+}
+
+// setMemberName changes the displayname of the ghost in a single room.
+func setMemberName(ctx context.Context, portal *bridgev2.Portal, ghost *bridgev2.Ghost, name string) {
+	_, err := ghost.Intent.SendState(ctx, portal.MXID, event.StateMember, ghost.Intent.GetMXID().String(), &event.Content{
+		Parsed: &event.MemberEventContent{
+			Membership:  event.MembershipJoin,
+			Displayname: name,
+			AvatarURL:   ghost.AvatarMXC,
+		},
+	}, time.Time{})
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).
+			Str("contact_id", string(ghost.ID)).
+			Stringer("room_id", portal.MXID).
+			Msg("Failed to set contact name in DM")
+	}
+}
@@ -0,0 +1,83 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// groupTypeGroup is the only group type in GroupCreateParams.Type supported by the remote network.
+const groupTypeGroup = "group"
+
+// Limits of the remote network for group metadata, counted in characters rather than bytes.
+const (
+	groupNameMaxLength  = 100
+	groupTopicMaxLength = 1000
+)
+
+// Ensure MyNetworkClient implements GroupCreatingNetworkAPI.
+var _ bridgev2.GroupCreatingNetworkAPI = (*MyNetworkClient)(nil)
+
+// CreateGroup implements bridgev2.GroupCreatingNetworkAPI.
+// The limits declared in the general capabilities are already checked by the bridge before this is called.
+// Participants that the remote refuses to add (e.g. because of their privacy settings) are reported
+// as failed participants, the group is still created without them.
+func (nc *MyNetworkClient) CreateGroup(ctx context.Context, params *bridgev2.GroupCreateParams) (*bridgev2.CreateChatResponse, error) {
+	log := zerolog.Ctx(ctx)
+	if params.RoomID != "" {
+		return nil, bridgev2.RespError(mautrix.MUnrecognized.WithMessage("Creating groups for existing rooms is not supported"))
+	} else if len(params.Participants) > nc.connector.Config.Groups.MaxParticipants {
+		return nil, bridgev2.RespError(mautrix.MInvalidParam.WithMessage("Must have at most %d members", nc.connector.Config.Groups.MaxParticipants))
+	}
+	req := &CreateChatRequest{
+		Type:    ChatTypeGroup,
+		Members: params.Participants,
+	}
+	if params.Name != nil {
+		req.Name = params.Name.Name
+	}
+	if params.Topic != nil {
+		req.Topic = params.Topic.Topic
+	}
+	if params.Avatar != nil && params.Avatar.URL != "" {
+		data, err := nc.bridge.Bot.DownloadMedia(ctx, params.Avatar.URL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download avatar: %w", err)
+		}
+		req.AvatarURL, err = nc.remote.UploadMedia(ctx, data, http.DetectContentType(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload avatar: %w", err)
+		}
+	}
+
+	chat, err := nc.remote.CreateChat(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create group: %w", err)
+	}
+	log.Info().
+		Str("chat_id", string(chat.ID)).
+		Int("failed_participants", len(chat.FailedMembers)).
+		Msg("Created remote group")
+
+	info := nc.chatInfoFromNetworkChat(ctx, &chat.NetworkChat)
+	if chat.AvatarURL != "" && params.Avatar != nil {
+		// Reuse the Matrix avatar instead of downloading it back from the remote.
+		info.Avatar.MXC = params.Avatar.URL
+	}
+	resp := &bridgev2.CreateChatResponse{
+		PortalKey:  nc.makePortalKey(chat.ID),
+		PortalInfo: info,
+	}
+	if len(chat.FailedMembers) > 0 {
+		resp.FailedParticipants = make(map[networkid.UserID]*bridgev2.CreateChatFailedParticipant, len(chat.FailedMembers))
+		for _, failed := range chat.FailedMembers {
+			resp.FailedParticipants[failed.UserID] = &bridgev2.CreateChatFailedParticipant{Reason: failed.Reason}
+		}
+	}
+	return resp, nil
+}
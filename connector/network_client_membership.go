@@ -0,0 +1,166 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+)
+
+// ErrMemberActionForbidden is returned for Matrix membership changes that the user's role in the remote chat doesn't allow.
+var ErrMemberActionForbidden = bridgev2.WrapErrorInStatus(errors.New("you don't have permission to change members in this chat")).
+	WithStatus(event.MessageStatusFail).
+	WithErrorReason(event.MessageStatusNoPermission).
+	WithErrorAsMessage().
+	WithIsCertain(true)
+
+// Ensure MyNetworkClient implements MembershipHandlingNetworkAPI.
+var _ bridgev2.MembershipHandlingNetworkAPI = (*MyNetworkClient)(nil)
+
+// HandleMatrixMembership implements bridgev2.MembershipHandlingNetworkAPI.
+// Invites add the user to the remote chat directly, as the remote network has no pending invites.
+// Leaves only reach this when bridge_matrix_leave is enabled in the bridge config.
+func (nc *MyNetworkClient) HandleMatrixMembership(ctx context.Context, msg *bridgev2.MatrixMembershipChange) (*bridgev2.MatrixMembershipResult, error) {
+	log := zerolog.Ctx(ctx)
+	meta := msg.Portal.Metadata.(*PortalMetadata)
+	chatType := meta.GetChatType()
+	role := meta.RoleOf(nc.remoteUserID())
+
+	var action MemberAction
+	var allowed bool
+	switch msg.Type {
+	case bridgev2.Invite:
+		action, allowed = MemberActionAdd, chatType.CanInvite(role)
+	case bridgev2.Kick, bridgev2.RevokeInvite:
+		action, allowed = MemberActionRemove, chatType.CanManageMembers(role)
+	case bridgev2.BanJoined, bridgev2.BanInvited, bridgev2.BanLeft, bridgev2.BanKnocked:
+		action, allowed = MemberActionBan, chatType.CanManageMembers(role)
+	case bridgev2.Unban:
+		action, allowed = MemberActionUnban, chatType.CanManageMembers(role)
+	case bridgev2.Leave, bridgev2.RejectInvite:
+		// The bridge only checks bridge_matrix_leave for leaves, but rejecting the portal invite is leaving too.
+		if !nc.bridge.Config.BridgeMatrixLeave {
+			return nil, nil
+		}
+		action, allowed = MemberActionLeave, true
+	case bridgev2.AcceptInvite, bridgev2.ProfileChange:
+		// The user is already a member on the remote.
+		return nil, nil
+	default:
+		return nil, bridgev2.ErrMembershipNotSupported
+	}
+	if chatType == ChatTypeDM {
+		if action == MemberActionLeave {
+			log.Debug().Msg("Not leaving DM on remote network")
+			return nil, nil
+		}
+		return nil, bridgev2.ErrMembershipNotSupported
+	} else if !allowed {
+		return nil, ErrMemberActionForbidden
+	}
+
+	targetID, ok := remoteMemberID(msg.Target)
+	if !ok {
+		log.Debug().Msg("Ignoring membership change of Matrix user who isn't on the remote network")
+		return nil, nil
+	}
+	err := nc.remote.ChangeMember(ctx, &ChangeMemberRequest{
+		ChatID: msg.Portal.ID,
+		UserID: targetID,
+		Action: action,
+		Reason: msg.Content.Reason,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to %s member: %w", action, err)
+	}
+	log.Debug().Str("action", string(action)).Str("target_id", string(targetID)).Msg("Changed remote chat membership")
+	return nil, nil
+}
+
+// Ensure MyNetworkClient implements PowerLevelHandlingNetworkAPI.
+var _ bridgev2.PowerLevelHandlingNetworkAPI = (*MyNetworkClient)(nil)
+
+// HandleMatrixPowerLevels implements bridgev2.PowerLevelHandlingNetworkAPI.
+// User power levels are mapped to remote roles with the power_levels config, and role changes are sent to the
+// remote as promotions or demotions. The rest of the power levels event isn't bridged. Levels that aren't the
+// exact level of a role are corrected, and changes that aren't permitted are reverted with a notice.
+func (nc *MyNetworkClient) HandleMatrixPowerLevels(ctx context.Context, msg *bridgev2.MatrixPowerLevelChange) (bool, error) {
+	portal := msg.Portal
+	meta := portal.Metadata.(*PortalMetadata)
+	chatType := meta.GetChatType()
+	ownRole := meta.RoleOf(nc.remoteUserID())
+	levels := &nc.connector.Config.PowerLevels
+
+	corrected := msg.Content.Clone()
+	needsCorrection := false
+	changed := false
+	var errs []error
+	for userID, change := range msg.Users {
+		targetID, ok := remoteMemberID(change.Target)
+		if !ok {
+			// Matrix users who aren't on the remote can have any power level.
+			continue
+		}
+		from := meta.RoleOf(targetID)
+		to := levels.RoleFor(change.NewLevel)
+		if to != from {
+			if !chatType.CanChangeRole(ownRole, from, to) {
+				errs = append(errs, fmt.Errorf("you can't change the role of %s from %s to %s", targetID, from, to))
+				to = from
+			} else if err := nc.remote.ChangeMember(ctx, &ChangeMemberRequest{
+				ChatID: portal.ID,
+				UserID: targetID,
+				Action: MemberActionSetRole,
+				Role:   to,
+			}); err != nil {
+				errs = append(errs, fmt.Errorf("failed to change the role of %s: %w", targetID, err))
+				to = from
+			} else {
+				zerolog.Ctx(ctx).Debug().
+					Str("target_id", string(targetID)).
+					Str("from_role", string(from)).
+					Str("to_role", string(to)).
+					Msg("Changed remote member role")
+				changed = setPortalRole(targetID, to)(ctx, portal) || changed
+			}
+		}
+		if level := levels.ForRole(to); level != change.NewLevel {
+			corrected.SetUserLevel(userID, level)
+			needsCorrection = true
+		}
+	}
+	err := errors.Join(errs...)
+	if needsCorrection {
+		var notice string
+		if err != nil {
+			notice = fmt.Sprintf("Couldn't change power levels: %v", err)
+		}
+		nc.sendRoomInfo(ctx, portal, event.StatePowerLevels, corrected, notice)
+	}
+	if err != nil {
+		return changed, bridgev2.WrapErrorInStatus(err).
+			WithStatus(event.MessageStatusFail).
+			WithErrorReason(event.MessageStatusNoPermission).
+			WithErrorAsMessage().
+			WithIsCertain(true).
+			WithSendNotice(false)
+	}
+	return changed, nil
+}
+
+// remoteMemberID returns the remote user ID of a member event target. It returns false for Matrix users
+// who aren't logged into the bridge, as they aren't on the remote network.
+func remoteMemberID(target bridgev2.GhostOrUserLogin) (networkid.UserID, bool) {
+	switch typedTarget := target.(type) {
+	case *bridgev2.Ghost:
+		return typedTarget.ID, true
+	case *bridgev2.UserLogin:
+		return loginRemoteUserID(typedTarget), true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,64 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// IdentifierResolvingNetworkAPI lets users start chats with `start-chat` and the provisioning API.
+var _ bridgev2.IdentifierResolvingNetworkAPI = (*MyNetworkClient)(nil)
+
+// ResolveIdentifier implements [bridgev2.IdentifierResolvingNetworkAPI].
+// The identifier can be a username, an email address or a phone number, see parseIdentifier.
+func (nc *MyNetworkClient) ResolveIdentifier(ctx context.Context, identifier string, createChat bool) (*bridgev2.ResolveIdentifierResponse, error) {
+	req, err := parseIdentifier(identifier)
+	if err != nil {
+		return nil, err
+	}
+	user, err := nc.remote.LookupUser(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up user: %w", err)
+	} else if user == nil {
+		return nil, nil
+	}
+	resp, err := nc.resolveNetworkUser(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	if createChat {
+		if nc.IsThisUser(ctx, user.ID) {
+			return nil, bridgev2.WrapRespErr(errors.New("you can't start a chat with yourself"), mautrix.MInvalidParam)
+		}
+		chat, err := nc.remote.CreateChat(ctx, &CreateChatRequest{
+			Type:    ChatTypeDM,
+			Members: []networkid.UserID{user.ID},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create chat: %w", err)
+		}
+		resp.Chat = &bridgev2.CreateChatResponse{
+			PortalKey:  nc.makePortalKey(chat.ID),
+			PortalInfo: nc.chatInfoFromNetworkChat(ctx, &chat.NetworkChat),
+		}
+	}
+	return resp, nil
+}
+
+// resolveNetworkUser returns the ghost and ghost info for a remote user.
+func (nc *MyNetworkClient) resolveNetworkUser(ctx context.Context, user *NetworkUser) (*bridgev2.ResolveIdentifierResponse, error) {
+	ghost, err := nc.bridge.GetGhostByID(ctx, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ghost: %w", err)
+	}
+	profile := user.ghostMetadata()
+	return &bridgev2.ResolveIdentifierResponse{
+		Ghost:    ghost,
+		UserID:   user.ID,
+		UserInfo: nc.userInfo(&profile),
+	}, nil
+}
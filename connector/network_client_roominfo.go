@@ -0,0 +1,183 @@
+package connector
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/jsontime"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+)
+
+// Ensure MyNetworkClient implements the room metadata handling interfaces.
+var (
+	_ bridgev2.RoomNameHandlingNetworkAPI   = (*MyNetworkClient)(nil)
+	_ bridgev2.RoomTopicHandlingNetworkAPI  = (*MyNetworkClient)(nil)
+	_ bridgev2.RoomAvatarHandlingNetworkAPI = (*MyNetworkClient)(nil)
+
+	_ bridgev2.DisappearTimerChangingNetworkAPI = (*MyNetworkClient)(nil)
+)
+
+// HandleMatrixRoomName implements bridgev2.RoomNameHandlingNetworkAPI.
+func (nc *MyNetworkClient) HandleMatrixRoomName(ctx context.Context, msg *bridgev2.MatrixRoomName) (bool, error) {
+	portal := msg.Portal
+	current := &event.RoomNameEventContent{Name: portal.Name}
+	name := strings.TrimSpace(msg.Content.Name)
+	if err := nc.checkCanEditInfo(portal); err != nil {
+		return false, nc.rejectRoomInfoChange(ctx, portal, event.StateRoomName, current, "name", err)
+	} else if name == "" {
+		return false, nc.rejectRoomInfoChange(ctx, portal, event.StateRoomName, current, "name", errors.New("group chats must have a name"))
+	} else if utf8.RuneCountInString(name) > groupNameMaxLength {
+		return false, nc.rejectRoomInfoChange(ctx, portal, event.StateRoomName, current, "name", fmt.Errorf("names can be at most %d characters long", groupNameMaxLength))
+	} else if name == portal.Name {
+		nc.sendRoomInfo(ctx, portal, event.StateRoomName, current, "The name is unchanged on the remote network.")
+		return false, nil
+	}
+	err := nc.remote.UpdateChat(ctx, &UpdateChatRequest{ChatID: portal.ID, Name: &name})
+	if err != nil {
+		return false, nc.rejectRoomInfoChange(ctx, portal, event.StateRoomName, current, "name", err)
+	}
+	if name != msg.Content.Name {
+		// Show the name as the remote stores it.
+		nc.sendRoomInfo(ctx, portal, event.StateRoomName, &event.RoomNameEventContent{Name: name}, "")
+	}
+	portal.Name = name
+	portal.NameSet = true
+	portal.Metadata.(*PortalMetadata).InitialName = name
+	return true, nil
+}
+
+// HandleMatrixRoomTopic implements bridgev2.RoomTopicHandlingNetworkAPI.
+func (nc *MyNetworkClient) HandleMatrixRoomTopic(ctx context.Context, msg *bridgev2.MatrixRoomTopic) (bool, error) {
+	portal := msg.Portal
+	current := &event.TopicEventContent{Topic: portal.Topic}
+	topic := strings.TrimSpace(msg.Content.Topic)
+	if err := nc.checkCanEditInfo(portal); err != nil {
+		return false, nc.rejectRoomInfoChange(ctx, portal, event.StateTopic, current, "topic", err)
+	} else if utf8.RuneCountInString(topic) > groupTopicMaxLength {
+		return false, nc.rejectRoomInfoChange(ctx, portal, event.StateTopic, current, "topic", fmt.Errorf("topics can be at most %d characters long", groupTopicMaxLength))
+	} else if topic == portal.Topic {
+		nc.sendRoomInfo(ctx, portal, event.StateTopic, current, "The topic is unchanged on the remote network.")
+		return false, nil
+	}
+	err := nc.remote.UpdateChat(ctx, &UpdateChatRequest{ChatID: portal.ID, Topic: &topic})
+	if err != nil {
+		return false, nc.rejectRoomInfoChange(ctx, portal, event.StateTopic, current, "topic", err)
+	}
+	if topic != msg.Content.Topic {
+		nc.sendRoomInfo(ctx, portal, event.StateTopic, &event.TopicEventContent{Topic: topic}, "")
+	}
+	portal.Topic = topic
+	portal.TopicSet = true
+	portal.Metadata.(*PortalMetadata).RemoteTopic = topic
+	return true, nil
+}
+
+// HandleMatrixRoomAvatar implements bridgev2.RoomAvatarHandlingNetworkAPI.
+// The new avatar is uploaded to the remote. Removing the avatar removes it on the remote too.
+func (nc *MyNetworkClient) HandleMatrixRoomAvatar(ctx context.Context, msg *bridgev2.MatrixRoomAvatar) (bool, error) {
+	portal := msg.Portal
+	current := &event.RoomAvatarEventContent{URL: portal.AvatarMXC}
+	if err := nc.checkCanEditInfo(portal); err != nil {
+		return false, nc.rejectRoomInfoChange(ctx, portal, event.StateRoomAvatar, current, "avatar", err)
+	}
+	var remoteURL string
+	var hash [32]byte
+	if msg.Content.URL != "" {
+		data, err := nc.bridge.Bot.DownloadMedia(ctx, msg.Content.URL, nil)
+		if err != nil {
+			return false, nc.rejectRoomInfoChange(ctx, portal, event.StateRoomAvatar, current, "avatar", fmt.Errorf("failed to download avatar: %w", err))
+		}
+		hash = sha256.Sum256(data)
+		if hash == portal.AvatarHash {
+			nc.sendRoomInfo(ctx, portal, event.StateRoomAvatar, current, "The avatar is unchanged on the remote network.")
+			return false, nil
+		}
+		remoteURL, err = nc.remote.UploadMedia(ctx, data, http.DetectContentType(data))
+		if err != nil {
+			return false, nc.rejectRoomInfoChange(ctx, portal, event.StateRoomAvatar, current, "avatar", fmt.Errorf("failed to upload avatar: %w", err))
+		}
+	}
+	err := nc.remote.UpdateChat(ctx, &UpdateChatRequest{ChatID: portal.ID, AvatarURL: &remoteURL})
+	if err != nil {
+		return false, nc.rejectRoomInfoChange(ctx, portal, event.StateRoomAvatar, current, "avatar", err)
+	}
+	// The avatar ID is the remote URL, like for avatars bridged from the remote, so the echo doesn't reupload it.
+	portal.AvatarID = networkid.AvatarID(remoteURL)
+	portal.AvatarMXC = msg.Content.URL
+	portal.AvatarHash = hash
+	portal.AvatarSet = true
+	return true, nil
+}
+
+// HandleMatrixDisappearingTimer implements bridgev2.DisappearTimerChangingNetworkAPI.
+// The bridge has already checked that the timer is one of those in the room capabilities.
+func (nc *MyNetworkClient) HandleMatrixDisappearingTimer(ctx context.Context, msg *bridgev2.MatrixDisappearingTimer) (bool, error) {
+	portal := msg.Portal
+	current := portal.Disappear.ToEventContent()
+	setting := database.DisappearingSettingFromEvent(msg.Content).Normalize()
+	meta := portal.Metadata.(*PortalMetadata)
+	if chatType := meta.GetChatType(); chatType != ChatTypeDM && !chatType.CanEditInfo(meta.RoleOf(nc.remoteUserID())) {
+		// Anyone can change the timer of a DM, in other chats it's part of the chat info.
+		err := errors.New("you don't have permission to change the info of this chat")
+		return false, nc.rejectRoomInfoChange(ctx, portal, event.StateBeeperDisappearingTimer, current, "disappearing message timer", err)
+	}
+	err := nc.remote.UpdateChat(ctx, &UpdateChatRequest{ChatID: portal.ID, DisappearTimer: ptr.Ptr(jsontime.S(setting.Timer))})
+	if err != nil {
+		return false, nc.rejectRoomInfoChange(ctx, portal, event.StateBeeperDisappearingTimer, current, "disappearing message timer", err)
+	}
+	portal.Disappear = setting
+	return true, nil
+}
+
+// checkCanEditInfo returns an error if the user isn't allowed to change the info of the chat.
+func (nc *MyNetworkClient) checkCanEditInfo(portal *bridgev2.Portal) error {
+	meta := portal.Metadata.(*PortalMetadata)
+	chatType := meta.GetChatType()
+	if chatType == ChatTypeDM {
+		return errors.New("direct chats use the other user's profile")
+	} else if !chatType.CanEditInfo(meta.RoleOf(nc.remoteUserID())) {
+		return errors.New("you don't have permission to change the info of this chat")
+	}
+	return nil
+}
+
+// rejectRoomInfoChange reverts a Matrix room info change that couldn't be applied on the remote network,
+// tells the user why and returns the error to send as the message status.
+func (nc *MyNetworkClient) rejectRoomInfoChange(ctx context.Context, portal *bridgev2.Portal, evtType event.Type, current any, what string, err error) error {
+	nc.sendRoomInfo(ctx, portal, evtType, current, fmt.Sprintf("Couldn't change the %s: %v", what, err))
+	return bridgev2.WrapErrorInStatus(fmt.Errorf("failed to change %s: %w", what, err)).
+		WithStatus(event.MessageStatusFail).
+		WithErrorAsMessage().
+		WithIsCertain(true).
+		WithSendNotice(false)
+}
+
+// sendRoomInfo overwrites a room info state event as the bridge bot, followed by a notice if one is given.
+// It's used to revert Matrix changes that don't match the remote chat.
+func (nc *MyNetworkClient) sendRoomInfo(ctx context.Context, portal *bridgev2.Portal, evtType event.Type, content any, notice string) {
+	log := zerolog.Ctx(ctx)
+	_, err := nc.bridge.Bot.SendState(ctx, portal.MXID, evtType, "", &event.Content{Parsed: content}, time.Time{})
+	if err != nil {
+		log.Err(err).Stringer("event_type", evtType).Msg("Failed to revert room info change")
+	}
+	if notice == "" {
+		return
+	}
+	_, err = nc.bridge.Bot.SendMessage(ctx, portal.MXID, event.EventMessage, &event.Content{
+		Parsed: &event.MessageEventContent{MsgType: event.MsgNotice, Body: notice},
+	}, nil)
+	if err != nil {
+		log.Err(err).Msg("Failed to send notice about reverted room info change")
+	}
+}
@@ -0,0 +1,56 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+)
+
+// errChatSyncDisabled is returned by syncChats if network.sync.chat_limit is 0.
+var errChatSyncDisabled = errors.New("chat sync is disabled by network.sync.chat_limit being 0")
+
+// syncChats fetches the user's most recent chats from the remote and queues a resync for each of them,
+// which creates portals for chats that don't have one yet. It returns the number of chats that were queued.
+// Nothing is synced if network.sync.chat_limit is 0: portals are then only created when messages arrive.
+func (nc *MyNetworkClient) syncChats(ctx context.Context) (int, error) {
+	limit := nc.connector.Config.Sync.ChatLimit
+	if limit == 0 {
+		return 0, errChatSyncDisabled
+	}
+	chats, err := nc.remote.GetChats(ctx, limit)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get chats: %w", err)
+	}
+	for _, chat := range chats {
+		nc.queueRemoteEvent(ctx, &simplevent.ChatResync{
+			EventMeta: simplevent.EventMeta{
+				Type:         bridgev2.RemoteEventChatResync,
+				PortalKey:    nc.makePortalKey(chat.ID),
+				CreatePortal: true,
+			},
+			ChatInfo: nc.chatInfoFromNetworkChat(ctx, chat),
+		})
+	}
+	err = nc.updateMetadata(ctx, func(meta *LoginMetadata) {
+		meta.LastSyncAt = ptr.Ptr(time.Now())
+	})
+	if err != nil {
+		return len(chats), fmt.Errorf("failed to save last sync time: %w", err)
+	}
+	return len(chats), nil
+}
+
+// syncChatsOnConnect creates portals for the most recent chats of the login, up to network.sync.chat_limit.
+func (nc *MyNetworkClient) syncChatsOnConnect(ctx context.Context) {
+	count, err := nc.syncChats(ctx)
+	if err != nil {
+		nc.log.Err(err).Msg("Failed to sync chats after connecting")
+	} else {
+		nc.log.Info().Int("chat_count", count).Msg("Synced chats after connecting")
+	}
+}
@@ -0,0 +1,88 @@
+package connector
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+)
+
+// testRemote is a remoteAPI for tests. Calls to methods that aren't overridden panic.
+type testRemote struct {
+	remoteAPI
+	getEvents func(ctx context.Context, req *GetEventsRequest) (*GetEventsResponse, error)
+}
+
+func (tr *testRemote) GetEvents(ctx context.Context, req *GetEventsRequest) (*GetEventsResponse, error) {
+	return tr.getEvents(ctx, req)
+}
+
+// newTestClient returns a client for a login that's stored in a temporary database. The bridge only has
+// a database and no Matrix connection, so it can only be used to test code that doesn't touch Matrix.
+func newTestClient(t *testing.T, cfg NetworkConfig, remote remoteAPI) *MyNetworkClient {
+	t.Helper()
+	ctx := context.Background()
+	rawDB, err := dbutil.NewWithDialect(filepath.Join(t.TempDir(), "bridge.db")+"?_foreign_keys=on", "sqlite3")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = rawDB.Close()
+	})
+	connector := &MyConnector{log: zerolog.Nop(), Config: cfg}
+	br := &bridgev2.Bridge{
+		ID:      "test",
+		DB:      database.New("test", connector.GetDBMetaTypes(), rawDB),
+		Log:     zerolog.Nop(),
+		Network: connector,
+	}
+	connector.bridge = br
+	if err = br.DB.Upgrade(ctx); err != nil {
+		t.Fatalf("failed to upgrade database: %v", err)
+	}
+	user := &database.User{BridgeID: br.ID, MXID: "@user:example.org"}
+	if err = br.DB.User.Insert(ctx, user); err != nil {
+		t.Fatalf("failed to insert user: %v", err)
+	}
+	login := &bridgev2.UserLogin{
+		UserLogin: &database.UserLogin{
+			BridgeID:   br.ID,
+			UserMXID:   user.MXID,
+			ID:         MakeUserLoginID("alice"),
+			RemoteName: "alice",
+			Metadata:   &LoginMetadata{RemoteUserID: "alice"},
+		},
+		Bridge: br,
+		Log:    zerolog.Nop(),
+	}
+	if err = br.DB.UserLogin.Insert(ctx, login.UserLogin); err != nil {
+		t.Fatalf("failed to insert login: %v", err)
+	}
+	nc := &MyNetworkClient{
+		log:       zerolog.Nop(),
+		bridge:    br,
+		login:     login,
+		connector: connector,
+		remote:    remote,
+		dedup:     newEventDeduplicator(br, dedupCacheSize),
+		limiter:   newRateLimiter(cfg.RateLimits),
+	}
+	nc.outbox = newOutbox(nc)
+	login.Client = nc
+	return nc
+}
+
+// savedMetadata returns the login metadata as it's stored in the database.
+func savedMetadata(t *testing.T, nc *MyNetworkClient) *LoginMetadata {
+	t.Helper()
+	dbLogin, err := nc.bridge.DB.UserLogin.GetByID(context.Background(), nc.login.ID)
+	if err != nil || dbLogin == nil {
+		t.Fatalf("failed to get login from database: %v", err)
+	}
+	return dbLogin.Metadata.(*LoginMetadata)
+}
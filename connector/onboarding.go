@@ -0,0 +1,158 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+)
+
+// welcomeBotID is the remote ID of the ghost that greets new logins in their welcome room.
+const welcomeBotID networkid.UserID = "simplenetwork_ghosty_ghost"
+
+// onboardLogin creates the welcome room of a new login and sends the greeting and help messages into it.
+// It's called on every connect until it succeeds once, then LoginMetadata.OnboardedAt is set and saved.
+func (c *MyConnector) onboardLogin(login *bridgev2.UserLogin) {
+	log := c.log.With().
+		Str("action", "onboard login").
+		Str("user_mxid", string(login.User.MXID)).
+		Str("login_id", string(login.ID)).
+		Logger()
+	ctx := log.WithContext(context.Background())
+	nc := login.Client.(*MyNetworkClient)
+	var onboardedAt *time.Time
+	nc.withMetadata(func(meta *LoginMetadata) {
+		onboardedAt = meta.OnboardedAt
+	})
+	if !c.Config.Onboarding.Enabled {
+		return
+	} else if onboardedAt != nil {
+		log.Debug().Msg("Login has already been onboarded")
+		return
+	} else if _, alreadyRunning := c.onboarding.LoadOrStore(login.ID, struct{}{}); alreadyRunning {
+		return
+	}
+	defer c.onboarding.Delete(login.ID)
+
+	err := c.createWelcomeRoom(ctx, nc)
+	if err != nil {
+		log.Err(err).Msg("Failed to onboard login, will retry on next connect")
+		return
+	}
+	err = nc.updateMetadata(ctx, func(meta *LoginMetadata) {
+		meta.OnboardedAt = ptr.Ptr(time.Now())
+		meta.WelcomeRoomCreatedAt = nil
+		meta.WelcomeMessagesSent = nil
+	})
+	if err != nil {
+		log.Err(err).Msg("Failed to save login after onboarding")
+		return
+	}
+	log.Info().Msg("Onboarded login")
+}
+
+// createWelcomeRoom creates the welcome room and sends the welcome messages that haven't been sent yet.
+// Every step is saved in the login metadata, so a retry after a partial failure continues where it stopped.
+func (c *MyConnector) createWelcomeRoom(ctx context.Context, nc *MyNetworkClient) error {
+	login := nc.login
+	portal, err := c.bridge.GetPortalByKey(ctx, nc.systemPortalKey())
+	if err != nil {
+		return fmt.Errorf("failed to get welcome portal: %w", err)
+	}
+	ghost, err := c.bridge.GetGhostByID(ctx, welcomeBotID)
+	if err != nil {
+		return fmt.Errorf("failed to get welcome bot ghost: %w", err)
+	}
+	ghost.UpdateInfo(ctx, c.userInfoFromMetadata(&GhostMetadata{
+		RemoteUserID: string(welcomeBotID),
+		RemoteName:   "Ghosty Ghost",
+		Username:     "ghosty_ghost",
+		IsBot:        true,
+	}))
+
+	cfg := &c.Config.Onboarding
+	params := &OnboardingParams{
+		RemoteName:    login.RemoteName,
+		BotName:       ghost.Name,
+		NetworkName:   c.GetName().DisplayName,
+		CommandPrefix: c.bridge.Config.CommandPrefix,
+	}
+	var name, topic, greeting, help string
+	for _, tpl := range []struct {
+		name string
+		into *string
+	}{{"room_name", &name}, {"room_topic", &topic}, {"greeting", &greeting}, {"help", &help}} {
+		*tpl.into, err = cfg.Format(tpl.name, params)
+		if err != nil {
+			return err
+		}
+	}
+
+	if portal.MXID == "" {
+		err = portal.CreateMatrixRoom(ctx, login, &bridgev2.ChatInfo{
+			Name:  ptr.Ptr(name),
+			Topic: ptr.Ptr(topic),
+			Members: &bridgev2.ChatMemberList{
+				IsFull: true,
+				MemberMap: bridgev2.ChatMemberMap{
+					loginRemoteUserID(login): {
+						EventSender: bridgev2.EventSender{
+							IsFromMe:    true,
+							SenderLogin: login.ID,
+							Sender:      loginRemoteUserID(login),
+						},
+						Membership: event.MembershipJoin,
+						PowerLevel: ptr.Ptr(c.Config.PowerLevels.Owner),
+					},
+					welcomeBotID: {
+						EventSender: bridgev2.EventSender{Sender: welcomeBotID},
+						Membership:  event.MembershipJoin,
+					},
+				},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create welcome room: %w", err)
+		}
+	}
+	var roomCreated bool
+	var sent []string
+	nc.withMetadata(func(meta *LoginMetadata) {
+		roomCreated = meta.WelcomeRoomCreatedAt != nil
+		sent = slices.Clone(meta.WelcomeMessagesSent)
+	})
+	if !roomCreated {
+		err = nc.updateMetadata(ctx, func(meta *LoginMetadata) {
+			meta.WelcomeRoomCreatedAt = ptr.Ptr(time.Now())
+		})
+		if err != nil {
+			return fmt.Errorf("failed to save welcome room creation: %w", err)
+		}
+	}
+	for _, msg := range []struct {
+		name string
+		text string
+	}{{"greeting", greeting}, {"help", help}} {
+		if msg.text == "" || slices.Contains(sent, msg.name) {
+			continue
+		}
+		content := format.RenderMarkdown(msg.text, true, false)
+		_, err = ghost.Intent.SendMessage(ctx, portal.MXID, event.EventMessage, &event.Content{Parsed: &content}, nil)
+		if err != nil {
+			return fmt.Errorf("failed to send welcome %s: %w", msg.name, err)
+		}
+		err = nc.updateMetadata(ctx, func(meta *LoginMetadata) {
+			meta.WelcomeMessagesSent = append(meta.WelcomeMessagesSent, msg.name)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to save sent welcome %s: %w", msg.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,403 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/status"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	// outboxMaxAttempts is the number of send attempts before a message is given up on.
+	outboxMaxAttempts = 8
+	outboxBaseBackoff = 2 * time.Second
+	outboxMaxBackoff  = 5 * time.Minute
+
+	// outboxEchoWindow is how long the transaction ID of a saved message is remembered to drop its remote echo
+	// without a database lookup.
+	outboxEchoWindow = time.Hour
+
+	rateLimitedStatusMessage = "Rate limited, retrying"
+)
+
+// OutboxEntry is a message sent from Matrix that hasn't been accepted by the remote network yet.
+// Entries are stored in LoginMetadata so that they survive restarts.
+type OutboxEntry struct {
+	TxnID       networkid.TransactionID `json:"txn_id"`
+	Portal      networkid.PortalKey     `json:"portal"`
+	RoomID      id.RoomID               `json:"room_id"`
+	EventID     id.EventID              `json:"event_id"`
+	Sender      id.UserID               `json:"sender"`
+	MsgType     event.MessageType       `json:"msg_type"`
+	Text        string                  `json:"text"`
+	Timestamp   time.Time               `json:"timestamp"`
+	Attempts    int                     `json:"attempts,omitempty"`
+	NextAttempt time.Time               `json:"next_attempt,omitempty"`
+
+	// msg is only set for messages queued since the bridge started, it's used for message statuses.
+	// Entries restored from the database don't have it.
+	msg *bridgev2.MatrixMessage
+}
+
+// outbox sends messages to the remote network in the background, retrying transient failures
+// with exponential backoff. Messages in the same portal are always sent in the order they were queued.
+//
+// The outbox saves sent messages to the database from the send response, so it works without an event stream.
+// Messages queued since the bridge started are also registered as pending with the bridge, which saves them
+// from the remote echo instead if it arrives before the send response. Echoes of saved messages are dropped
+// by the deduplicator, as the message is in the database. The entries themselves are stored in LoginMetadata,
+// so they're only changed through MyNetworkClient.updateMetadata.
+type outbox struct {
+	client *MyNetworkClient
+
+	lock   sync.Mutex
+	cancel context.CancelFunc
+	wake   chan struct{}
+	// sentEchoes contains the transaction IDs of messages that were saved to the database recently, with the
+	// time they were saved. Their echoes must not be bridged again.
+	sentEchoes map[networkid.TransactionID]time.Time
+}
+
+func newOutbox(client *MyNetworkClient) *outbox {
+	return &outbox{
+		client:     client,
+		wake:       make(chan struct{}, 1),
+		sentEchoes: make(map[networkid.TransactionID]time.Time),
+	}
+}
+
+// Len returns the number of messages waiting to be sent.
+func (ob *outbox) Len() (n int) {
+	ob.client.withMetadata(func(meta *LoginMetadata) {
+		n = len(meta.Outbox)
+	})
+	return
+}
+
+// Start starts sending queued messages. It's called when the client has connected.
+func (ob *outbox) Start() {
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	if ob.cancel != nil {
+		return
+	}
+	var ctx context.Context
+	ctx, ob.cancel = context.WithCancel(ob.client.log.With().Str("component", "outbox").Logger().WithContext(context.Background()))
+	go ob.run(ctx)
+}
+
+// Stop stops sending messages. Queued messages are kept and sent after the next Start.
+func (ob *outbox) Stop() {
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	if ob.cancel != nil {
+		ob.cancel()
+		ob.cancel = nil
+	}
+}
+
+func (ob *outbox) isRunning() bool {
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	return ob.cancel != nil
+}
+
+func (ob *outbox) wakeUp() {
+	select {
+	case ob.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Enqueue stores a Matrix message in the outbox.
+func (ob *outbox) Enqueue(ctx context.Context, msg *bridgev2.MatrixMessage, txnID networkid.TransactionID) error {
+	entry := &OutboxEntry{
+		TxnID:     txnID,
+		Portal:    msg.Portal.PortalKey,
+		RoomID:    msg.Event.RoomID,
+		EventID:   msg.Event.ID,
+		Sender:    msg.Event.Sender,
+		MsgType:   msg.Content.MsgType,
+		Text:      msg.Content.Body,
+		Timestamp: time.UnixMilli(msg.Event.Timestamp),
+		msg:       msg,
+	}
+	err := ob.client.updateMetadata(ctx, func(meta *LoginMetadata) {
+		meta.Outbox = append(meta.Outbox, entry)
+	})
+	if err != nil {
+		ob.client.withMetadata(func(meta *LoginMetadata) {
+			meta.Outbox = slices.DeleteFunc(meta.Outbox, func(e *OutboxEntry) bool {
+				return e == entry
+			})
+		})
+		return fmt.Errorf("failed to save outbox: %w", err)
+	}
+	if !ob.isRunning() {
+		ob.sendStatus(ctx, entry, bridgev2.MessageStatus{
+			Status:  event.MessageStatusPending,
+			Message: "Waiting for the connection to the remote network",
+		})
+	}
+	ob.wakeUp()
+	return nil
+}
+
+// IsSentEcho returns true if the transaction ID belongs to a message that the outbox has recently saved to the
+// database, so that its echo can be dropped without a database lookup.
+func (ob *outbox) IsSentEcho(txnID networkid.TransactionID) bool {
+	if txnID == "" {
+		return false
+	}
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	_, ok := ob.sentEchoes[txnID]
+	return ok
+}
+
+// rememberEcho remembers the transaction ID of a saved message. Transaction IDs of messages saved more than
+// outboxEchoWindow ago are forgotten, their echoes are found in the database instead.
+func (ob *outbox) rememberEcho(txnID networkid.TransactionID) {
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	now := time.Now()
+	for otherTxnID, sentAt := range ob.sentEchoes {
+		if now.Sub(sentAt) > outboxEchoWindow {
+			delete(ob.sentEchoes, otherTxnID)
+		}
+	}
+	ob.sentEchoes[txnID] = now
+}
+
+func (ob *outbox) run(ctx context.Context) {
+	log := zerolog.Ctx(ctx)
+	log.Debug().Msg("Outbox started")
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		next := ob.sendDue(ctx)
+		wait := time.Hour
+		if !next.IsZero() {
+			wait = max(time.Until(next), 0)
+		}
+		timer.Reset(wait)
+		select {
+		case <-ctx.Done():
+			log.Debug().Msg("Outbox stopped")
+			return
+		case <-ob.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// sendDue attempts every entry whose backoff has expired and returns the earliest time an entry is due next.
+// Once an entry in a portal can't be sent, later entries in the same portal are held back to keep them in order.
+func (ob *outbox) sendDue(ctx context.Context) (next time.Time) {
+	var entries []*OutboxEntry
+	ob.client.withMetadata(func(meta *LoginMetadata) {
+		entries = slices.Clone(meta.Outbox)
+	})
+
+	blocked := make(map[networkid.PortalKey]struct{})
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return
+		}
+		if _, isBlocked := blocked[entry.Portal]; isBlocked {
+			continue
+		}
+		if time.Now().Before(entry.NextAttempt) {
+			blocked[entry.Portal] = struct{}{}
+			if next.IsZero() || entry.NextAttempt.Before(next) {
+				next = entry.NextAttempt
+			}
+			continue
+		}
+		if !ob.attempt(ctx, entry) {
+			blocked[entry.Portal] = struct{}{}
+			if next.IsZero() || entry.NextAttempt.Before(next) {
+				next = entry.NextAttempt
+			}
+		}
+	}
+	return
+}
+
+// attempt tries to send a single entry. It returns false if the entry stays in the outbox for a retry.
+func (ob *outbox) attempt(ctx context.Context, entry *OutboxEntry) bool {
+	log := zerolog.Ctx(ctx).With().
+		Str("txn_id", string(entry.TxnID)).
+		Stringer("event_id", entry.EventID).
+		Int("attempt", entry.Attempts+1).
+		Logger()
+	if delay := ob.client.limiter.Delay(actionSend); delay > 0 {
+		// The send below blocks until the rate limit allows it, tell the sender why nothing is happening.
+		log.Debug().Dur("delay", delay).Msg("Queued message is being held back by rate limit")
+		ob.sendStatus(ctx, entry, bridgev2.MessageStatus{
+			Status:   event.MessageStatusPending,
+			RetryNum: entry.Attempts,
+			Message:  rateLimitedStatusMessage,
+		})
+	}
+	sent, err := ob.client.remote.SendMessage(ctx, &SendMessageRequest{
+		ChatID:        entry.Portal.ID,
+		Text:          entry.Text,
+		TransactionID: entry.TxnID,
+	})
+	if err == nil {
+		log.Debug().Str("remote_message_id", sent.ID).Msg("Sent queued message")
+		ob.markSent(ctx, entry, sent)
+		return true
+	}
+	if ctx.Err() != nil {
+		// Disconnected mid-send, try again after reconnecting without counting the attempt.
+		return false
+	} else if retryAfter, isRateLimited := isRateLimitError(err); isRateLimited {
+		// Rate limits aren't failures of the message itself, so they don't count towards the attempt limit.
+		saveErr := ob.client.updateMetadata(ctx, func(meta *LoginMetadata) {
+			entry.NextAttempt = time.Now().Add(retryAfter)
+		})
+		if saveErr != nil {
+			log.Err(saveErr).Msg("Failed to save outbox after rate limit")
+		}
+		log.Warn().Dur("retry_after", retryAfter).Msg("Remote rate limited queued message, will retry")
+		ob.sendStatus(ctx, entry, bridgev2.MessageStatus{
+			Status:        event.MessageStatusPending,
+			RetryNum:      entry.Attempts,
+			InternalError: err,
+			Message:       rateLimitedStatusMessage,
+		})
+		return false
+	}
+
+	// The outbox goroutine is the only writer of entries, so it can read them without the metadata lock.
+	ob.client.withMetadata(func(meta *LoginMetadata) {
+		entry.Attempts++
+	})
+	if isRetriableError(err) && entry.Attempts < outboxMaxAttempts {
+		saveErr := ob.client.updateMetadata(ctx, func(meta *LoginMetadata) {
+			entry.NextAttempt = time.Now().Add(min(outboxBaseBackoff<<(entry.Attempts-1), outboxMaxBackoff))
+		})
+		if saveErr != nil {
+			log.Err(saveErr).Msg("Failed to save outbox after failed attempt")
+		}
+		log.Warn().Err(err).Time("next_attempt", entry.NextAttempt).Msg("Failed to send queued message, will retry")
+		ob.sendStatus(ctx, entry, bridgev2.MessageStatus{
+			Status:        event.MessageStatusPending,
+			RetryNum:      entry.Attempts,
+			InternalError: err,
+			Message:       "Sending failed, retrying",
+		})
+		return false
+	}
+
+	log.Err(err).Msg("Giving up on queued message")
+	msgStatus := bridgev2.MessageStatus{
+		Status:        event.MessageStatusFail,
+		ErrorReason:   event.MessageStatusNetworkError,
+		RetryNum:      entry.Attempts,
+		InternalError: err,
+		IsCertain:     true,
+		SendNotice:    true,
+	}
+	if isRetriableError(err) {
+		// The remote might accept the message later, so let the user retry manually.
+		msgStatus.Status = event.MessageStatusRetriable
+		msgStatus.IsCertain = false
+	}
+	ob.sendStatus(ctx, entry, msgStatus)
+	if entry.msg != nil {
+		entry.msg.RemovePending(entry.TxnID)
+	}
+	ob.remove(ctx, entry)
+	return true
+}
+
+// markSent saves a sent entry to the database, tells the sender that it was delivered and removes it from the outbox.
+// If the echo has arrived first, the bridge has already saved the message through the pending message.
+func (ob *outbox) markSent(ctx context.Context, entry *OutboxEntry, sent *NetworkMessage) {
+	log := zerolog.Ctx(ctx)
+	messageID := MakeMessageID(entry.Portal.ID, sent.ID)
+	existing, err := ob.client.bridge.DB.Message.GetFirstPartByID(ctx, entry.Portal.Receiver, messageID)
+	if err != nil {
+		log.Err(err).Msg("Failed to check if sent message is already in database")
+	} else if existing == nil {
+		err = ob.saveSent(ctx, entry, messageID, sent)
+		if err != nil {
+			log.Err(err).Msg("Failed to save sent message to database")
+		}
+	}
+	if err == nil {
+		ob.rememberEcho(entry.TxnID)
+		if entry.msg != nil {
+			entry.msg.RemovePending(entry.TxnID)
+		}
+	}
+	// If saving failed, the message stays pending, so that the bridge can still save it when the echo arrives.
+	ob.sendStatus(ctx, entry, bridgev2.MessageStatus{
+		Status:    event.MessageStatusSuccess,
+		IsCertain: true,
+	})
+	ob.remove(ctx, entry)
+}
+
+func (ob *outbox) saveSent(ctx context.Context, entry *OutboxEntry, messageID networkid.MessageID, sent *NetworkMessage) error {
+	senderID := ob.client.remoteUserID()
+	// Messages reference the ghost of their sender, which doesn't exist yet right after the first login.
+	_, err := ob.client.bridge.GetGhostByID(ctx, senderID)
+	if err != nil {
+		return fmt.Errorf("failed to get ghost of sender: %w", err)
+	}
+	timestamp := sent.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	return ob.client.bridge.DB.Message.Insert(ctx, &database.Message{
+		ID:         messageID,
+		PartID:     MakePartID(0),
+		MXID:       entry.EventID,
+		Room:       entry.Portal,
+		SenderID:   senderID,
+		SenderMXID: entry.Sender,
+		Timestamp:  timestamp,
+		SendTxnID:  networkid.RawTransactionID(entry.TxnID),
+	})
+}
+
+func (ob *outbox) remove(ctx context.Context, entry *OutboxEntry) {
+	err := ob.client.updateMetadata(ctx, func(meta *LoginMetadata) {
+		meta.Outbox = slices.DeleteFunc(meta.Outbox, func(e *OutboxEntry) bool {
+			return e.TxnID == entry.TxnID
+		})
+	})
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to save outbox after removing entry")
+	}
+}
+
+func (ob *outbox) sendStatus(ctx context.Context, entry *OutboxEntry, msgStatus bridgev2.MessageStatus) {
+	msgStatus.Step = status.MsgStepRemote
+	var info *bridgev2.MessageStatusEventInfo
+	if entry.msg != nil {
+		info = bridgev2.StatusEventInfoFromEvent(entry.msg.Event)
+	} else {
+		info = &bridgev2.MessageStatusEventInfo{
+			RoomID:        entry.RoomID,
+			SourceEventID: entry.EventID,
+			EventType:     event.EventMessage,
+			MessageType:   entry.MsgType,
+			Sender:        entry.Sender,
+		}
+	}
+	ob.client.bridge.Matrix.SendMessageStatus(ctx, &msgStatus, info)
+}
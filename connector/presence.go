@@ -0,0 +1,162 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridgev2/matrix"
+	"maunium.net/go/mautrix/event"
+)
+
+// presenceThrottleMaxKeys is the number of users whose last update is remembered before old entries are pruned.
+const presenceThrottleMaxKeys = 4096
+
+// presenceThrottle limits how often the presence of a single user is updated. Updates that arrive sooner than
+// the minimum interval after the previous one are held back, and only the newest of them is applied once the
+// interval has passed, so the final state is never lost.
+type presenceThrottle struct {
+	interval time.Duration
+
+	lock        sync.Mutex
+	lastApplied map[string]time.Time
+	pending     map[string]func()
+}
+
+func newPresenceThrottle(interval time.Duration) *presenceThrottle {
+	return &presenceThrottle{
+		interval:    interval,
+		lastApplied: make(map[string]time.Time),
+		pending:     make(map[string]func()),
+	}
+}
+
+// Do calls apply for the user with the given key, either right away or once the interval has passed.
+// An update that is still held back for the same key is replaced.
+func (pt *presenceThrottle) Do(key string, apply func()) {
+	pt.lock.Lock()
+	if _, waiting := pt.pending[key]; waiting {
+		pt.pending[key] = apply
+		pt.lock.Unlock()
+		return
+	}
+	wait := time.Until(pt.lastApplied[key].Add(pt.interval))
+	if wait > 0 {
+		pt.pending[key] = apply
+		time.AfterFunc(wait, func() { pt.applyPending(key) })
+		pt.lock.Unlock()
+		return
+	}
+	pt.markApplied(key)
+	pt.lock.Unlock()
+	apply()
+}
+
+func (pt *presenceThrottle) applyPending(key string) {
+	pt.lock.Lock()
+	apply := pt.pending[key]
+	delete(pt.pending, key)
+	pt.markApplied(key)
+	pt.lock.Unlock()
+	apply()
+}
+
+// markApplied remembers when the last update for the key was applied. The lock must be held.
+func (pt *presenceThrottle) markApplied(key string) {
+	now := time.Now()
+	if len(pt.lastApplied) >= presenceThrottleMaxKeys {
+		for otherKey, ts := range pt.lastApplied {
+			if now.Sub(ts) >= pt.interval {
+				delete(pt.lastApplied, otherKey)
+			}
+		}
+	}
+	pt.lastApplied[key] = now
+}
+
+// HandleRemotePresence shows the online status of a remote user as the presence of their ghost.
+// The bridge has no remote event type for presence, so the ghost's presence is set directly rather than queued.
+func (nc *MyNetworkClient) HandleRemotePresence(ctx context.Context, presence *NetworkPresence) {
+	if !nc.connector.Config.Presence.Receive || nc.IsThisUser(ctx, presence.UserID) {
+		return
+	}
+	// Ghosts are shared by all logins, so the throttle is too. Held back updates run after the caller has returned.
+	ctx = zerolog.Ctx(ctx).WithContext(context.WithoutCancel(ctx))
+	nc.connector.ghostPresence.Do(string(presence.UserID), func() {
+		nc.setGhostPresence(ctx, presence)
+	})
+}
+
+func (nc *MyNetworkClient) setGhostPresence(ctx context.Context, presence *NetworkPresence) {
+	log := zerolog.Ctx(ctx).With().Str("remote_user_id", string(presence.UserID)).Logger()
+	ghost, err := nc.bridge.GetGhostByID(ctx, presence.UserID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get ghost to update presence")
+		return
+	}
+	intent, ok := ghost.Intent.(*matrix.ASIntent)
+	if !ok {
+		return
+	}
+	req := mautrix.ReqPresence{Presence: presence.Status.MatrixPresence()}
+	if presence.Status != PresenceOnline && !presence.LastSeen.IsZero() {
+		req.StatusMsg = "Last seen " + presence.LastSeen.UTC().Format("2006-01-02 15:04 MST")
+	}
+	err = intent.Matrix.EnsureRegistered(ctx)
+	if err == nil {
+		err = intent.Matrix.SetPresence(ctx, req)
+	}
+	if err != nil {
+		log.Err(err).Msg("Failed to set ghost presence")
+	}
+}
+
+// registerPresenceHandler makes the bridge pass presence of Matrix users to the connector.
+// The bridge doesn't handle presence itself, so the handler is added to the appservice event processor.
+func (c *MyConnector) registerPresenceHandler() {
+	mc, ok := c.bridge.Matrix.(*matrix.Connector)
+	if !ok || !c.Config.Presence.Send {
+		return
+	}
+	mc.EventProcessor.On(event.EphemeralEventPresence, c.handleMatrixPresence)
+}
+
+// handleMatrixPresence sets the online status of all logins of a Matrix user to their presence.
+func (c *MyConnector) handleMatrixPresence(ctx context.Context, evt *event.Event) {
+	if c.bridge.IsGhostMXID(evt.Sender) || evt.Sender == c.bridge.Bot.GetMXID() {
+		return
+	}
+	content := evt.Content.AsPresence()
+	user, err := c.bridge.GetExistingUserByMXID(ctx, evt.Sender)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Stringer("user_id", evt.Sender).Msg("Failed to get user to bridge presence")
+		return
+	} else if user == nil {
+		return
+	}
+	status := PresenceStatusFromMatrix(content.Presence)
+	for _, login := range user.GetUserLogins() {
+		nc, ok := login.Client.(*MyNetworkClient)
+		if !ok || !nc.IsLoggedIn() || nc.presenceUnsupported.Load() {
+			continue
+		}
+		c.userPresence.Do(string(login.ID), func() {
+			nc.setRemotePresence(nc.log.WithContext(context.Background()), status)
+		})
+	}
+}
+
+func (nc *MyNetworkClient) setRemotePresence(ctx context.Context, status PresenceStatus) {
+	err := nc.remote.SetPresence(ctx, &SetPresenceRequest{Status: status})
+	if errors.Is(err, ErrPresenceUnsupported) {
+		nc.log.Info().Msg("Remote network doesn't support setting presence, not sending it anymore")
+		nc.presenceUnsupported.Store(true)
+	} else if err != nil {
+		nc.log.Err(err).Str("status", string(status)).Msg("Failed to set remote presence")
+	} else {
+		nc.log.Debug().Str("status", string(status)).Msg("Set remote presence")
+	}
+}
@@ -0,0 +1,300 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// actionClass groups remote API calls that share a rate limit.
+type actionClass string
+
+const (
+	actionSend    actionClass = "send"
+	actionHistory actionClass = "history"
+	actionProfile actionClass = "profile"
+	actionMedia   actionClass = "media"
+)
+
+// tokenBucket is a token bucket that hands out reservations: taking a token from an empty bucket
+// puts it into debt, and the caller has to wait until the debt has been refilled.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// pausedUntil is set when the remote has asked us to back off with Retry-After.
+	pausedUntil time.Time
+}
+
+func newTokenBucket(cfg RateLimit) *tokenBucket {
+	return &tokenBucket{
+		rate:   cfg.PerSecond,
+		burst:  float64(cfg.Burst),
+		tokens: float64(cfg.Burst),
+		last:   time.Now(),
+	}
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	if tb.rate <= 0 {
+		return
+	}
+	tb.tokens = min(tb.tokens+now.Sub(tb.last).Seconds()*tb.rate, tb.burst)
+	tb.last = now
+}
+
+// delay returns how long a call made now would have to wait, without taking a token.
+func (tb *tokenBucket) delay(now time.Time) time.Duration {
+	tb.refill(now)
+	var wait time.Duration
+	if tb.rate > 0 && tb.tokens < 1 {
+		wait = time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+	}
+	return max(wait, tb.pausedUntil.Sub(now))
+}
+
+// reserve takes a token and returns how long the caller must wait before making the call.
+func (tb *tokenBucket) reserve(now time.Time) time.Duration {
+	wait := tb.delay(now)
+	if tb.rate > 0 {
+		tb.tokens--
+	}
+	return wait
+}
+
+// cancel returns a token that was reserved but not used.
+func (tb *tokenBucket) cancel() {
+	if tb.rate > 0 {
+		tb.tokens = min(tb.tokens+1, tb.burst)
+	}
+}
+
+// rateLimiter holds the token buckets of a single login.
+type rateLimiter struct {
+	lock    sync.Mutex
+	buckets map[actionClass]*tokenBucket
+}
+
+func newRateLimiter(cfg RateLimitConfig) *rateLimiter {
+	return &rateLimiter{
+		buckets: map[actionClass]*tokenBucket{
+			actionSend:    newTokenBucket(cfg.Send),
+			actionHistory: newTokenBucket(cfg.History),
+			actionProfile: newTokenBucket(cfg.Profile),
+			actionMedia:   newTokenBucket(cfg.Media),
+		},
+	}
+}
+
+// Delay returns how long a call of the given class would currently be held back.
+func (rl *rateLimiter) Delay(class actionClass) time.Duration {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	return rl.buckets[class].delay(time.Now())
+}
+
+// Wait blocks until a call of the given class may be made, or until the context is cancelled.
+func (rl *rateLimiter) Wait(ctx context.Context, class actionClass) error {
+	rl.lock.Lock()
+	wait := rl.buckets[class].reserve(time.Now())
+	rl.lock.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	zerolog.Ctx(ctx).Debug().Str("action_class", string(class)).Dur("delay", wait).Msg("Waiting for rate limit")
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		rl.lock.Lock()
+		rl.buckets[class].cancel()
+		rl.lock.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Pause holds back all calls of the given class for the given duration.
+func (rl *rateLimiter) Pause(class actionClass, duration time.Duration) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	bucket := rl.buckets[class]
+	if until := time.Now().Add(duration); until.After(bucket.pausedUntil) {
+		bucket.pausedUntil = until
+	}
+}
+
+// handleError pauses the class if the remote rejected a call for exceeding its rate limit.
+func (rl *rateLimiter) handleError(ctx context.Context, class actionClass, err error) {
+	if retryAfter, ok := isRateLimitError(err); ok {
+		zerolog.Ctx(ctx).Warn().
+			Str("action_class", string(class)).
+			Dur("retry_after", retryAfter).
+			Msg("Remote API rate limit exceeded, pausing calls")
+		rl.Pause(class, retryAfter)
+	}
+}
+
+// isRateLimitError returns true and the requested backoff if the error is an HTTP 429 from the remote.
+func isRateLimitError(err error) (time.Duration, bool) {
+	var remoteErr *RemoteError
+	if errors.As(err, &remoteErr) && remoteErr.StatusCode == http.StatusTooManyRequests {
+		return remoteErr.RetryAfter, true
+	}
+	return 0, false
+}
+
+// rateLimitedRemoteAPI applies the login's rate limits to every call made to the remote API.
+type rateLimitedRemoteAPI struct {
+	api     remoteAPI
+	limiter *rateLimiter
+}
+
+var _ remoteAPI = (*rateLimitedRemoteAPI)(nil)
+
+func (r *rateLimitedRemoteAPI) SendMessage(ctx context.Context, req *SendMessageRequest) (*NetworkMessage, error) {
+	if err := r.limiter.Wait(ctx, actionSend); err != nil {
+		return nil, err
+	}
+	resp, err := r.api.SendMessage(ctx, req)
+	r.limiter.handleError(ctx, actionSend, err)
+	return resp, err
+}
+
+func (r *rateLimitedRemoteAPI) GetHistory(ctx context.Context, req *GetHistoryRequest) (*GetHistoryResponse, error) {
+	if err := r.limiter.Wait(ctx, actionHistory); err != nil {
+		return nil, err
+	}
+	resp, err := r.api.GetHistory(ctx, req)
+	r.limiter.handleError(ctx, actionHistory, err)
+	return resp, err
+}
+
+func (r *rateLimitedRemoteAPI) GetEvents(ctx context.Context, req *GetEventsRequest) (*GetEventsResponse, error) {
+	if err := r.limiter.Wait(ctx, actionHistory); err != nil {
+		return nil, err
+	}
+	resp, err := r.api.GetEvents(ctx, req)
+	r.limiter.handleError(ctx, actionHistory, err)
+	return resp, err
+}
+
+func (r *rateLimitedRemoteAPI) GetChats(ctx context.Context, limit int) ([]*NetworkChat, error) {
+	if err := r.limiter.Wait(ctx, actionHistory); err != nil {
+		return nil, err
+	}
+	resp, err := r.api.GetChats(ctx, limit)
+	r.limiter.handleError(ctx, actionHistory, err)
+	return resp, err
+}
+
+func (r *rateLimitedRemoteAPI) GetUser(ctx context.Context, userID networkid.UserID) (*NetworkUser, error) {
+	if err := r.limiter.Wait(ctx, actionProfile); err != nil {
+		return nil, err
+	}
+	resp, err := r.api.GetUser(ctx, userID)
+	r.limiter.handleError(ctx, actionProfile, err)
+	return resp, err
+}
+
+func (r *rateLimitedRemoteAPI) LookupUser(ctx context.Context, req *LookupUserRequest) (*NetworkUser, error) {
+	if err := r.limiter.Wait(ctx, actionProfile); err != nil {
+		return nil, err
+	}
+	resp, err := r.api.LookupUser(ctx, req)
+	r.limiter.handleError(ctx, actionProfile, err)
+	return resp, err
+}
+
+func (r *rateLimitedRemoteAPI) CreateChat(ctx context.Context, req *CreateChatRequest) (*CreatedChat, error) {
+	if err := r.limiter.Wait(ctx, actionSend); err != nil {
+		return nil, err
+	}
+	resp, err := r.api.CreateChat(ctx, req)
+	r.limiter.handleError(ctx, actionSend, err)
+	return resp, err
+}
+
+func (r *rateLimitedRemoteAPI) GetContacts(ctx context.Context) ([]*NetworkContact, error) {
+	if err := r.limiter.Wait(ctx, actionProfile); err != nil {
+		return nil, err
+	}
+	resp, err := r.api.GetContacts(ctx)
+	r.limiter.handleError(ctx, actionProfile, err)
+	return resp, err
+}
+
+func (r *rateLimitedRemoteAPI) SearchUsers(ctx context.Context, query string) ([]*NetworkUser, error) {
+	if err := r.limiter.Wait(ctx, actionProfile); err != nil {
+		return nil, err
+	}
+	resp, err := r.api.SearchUsers(ctx, query)
+	r.limiter.handleError(ctx, actionProfile, err)
+	return resp, err
+}
+
+func (r *rateLimitedRemoteAPI) Download(ctx context.Context, url string) ([]byte, error) {
+	if err := r.limiter.Wait(ctx, actionMedia); err != nil {
+		return nil, err
+	}
+	resp, err := r.api.Download(ctx, url)
+	r.limiter.handleError(ctx, actionMedia, err)
+	return resp, err
+}
+
+func (r *rateLimitedRemoteAPI) UploadMedia(ctx context.Context, data []byte, mimeType string) (string, error) {
+	if err := r.limiter.Wait(ctx, actionMedia); err != nil {
+		return "", err
+	}
+	resp, err := r.api.UploadMedia(ctx, data, mimeType)
+	r.limiter.handleError(ctx, actionMedia, err)
+	return resp, err
+}
+
+func (r *rateLimitedRemoteAPI) ChangeMember(ctx context.Context, req *ChangeMemberRequest) error {
+	if err := r.limiter.Wait(ctx, actionSend); err != nil {
+		return err
+	}
+	err := r.api.ChangeMember(ctx, req)
+	r.limiter.handleError(ctx, actionSend, err)
+	return err
+}
+
+func (r *rateLimitedRemoteAPI) UpdateChat(ctx context.Context, req *UpdateChatRequest) error {
+	if err := r.limiter.Wait(ctx, actionSend); err != nil {
+		return err
+	}
+	err := r.api.UpdateChat(ctx, req)
+	r.limiter.handleError(ctx, actionSend, err)
+	return err
+}
+
+func (r *rateLimitedRemoteAPI) GetAttachmentURL(ctx context.Context, req *GetAttachmentURLRequest) (*AttachmentURL, error) {
+	if err := r.limiter.Wait(ctx, actionMedia); err != nil {
+		return nil, err
+	}
+	resp, err := r.api.GetAttachmentURL(ctx, req)
+	r.limiter.handleError(ctx, actionMedia, err)
+	return resp, err
+}
+
+func (r *rateLimitedRemoteAPI) SetPresence(ctx context.Context, req *SetPresenceRequest) error {
+	if err := r.limiter.Wait(ctx, actionProfile); err != nil {
+		return err
+	}
+	err := r.api.SetPresence(ctx, req)
+	r.limiter.handleError(ctx, actionProfile, err)
+	return err
+}
+
+// Logout isn't rate limited, as waiting for a token would delay the logout and the token is revoked right after.
+func (r *rateLimitedRemoteAPI) Logout(ctx context.Context, req *LogoutRequest) error {
+	return r.api.Logout(ctx, req)
+}
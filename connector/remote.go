@@ -0,0 +1,680 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mau.fi/util/jsontime"
+	"go.mau.fi/util/retryafter"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// remoteAPI is the part of the remote network's API used by MyNetworkClient.
+//
+// If network.api_base_url is set, requests go to the remote over HTTP. Otherwise the built-in
+// simulated network is used, which accepts everything and echoes messages back on the event stream.
+type remoteAPI interface {
+	SendMessage(ctx context.Context, req *SendMessageRequest) (*NetworkMessage, error)
+	GetHistory(ctx context.Context, req *GetHistoryRequest) (*GetHistoryResponse, error)
+	// GetEvents returns the changes since a cursor from the remote event feed, oldest first.
+	GetEvents(ctx context.Context, req *GetEventsRequest) (*GetEventsResponse, error)
+	// GetChats returns the user's chats, most recently active first. A limit of 0 returns all chats.
+	GetChats(ctx context.Context, limit int) ([]*NetworkChat, error)
+	// GetUser returns the remote profile of a user, or nil if the remote doesn't know the user.
+	GetUser(ctx context.Context, userID networkid.UserID) (*NetworkUser, error)
+	// LookupUser finds a user by username, email or phone number. It returns nil if there's no such user.
+	LookupUser(ctx context.Context, req *LookupUserRequest) (*NetworkUser, error)
+	CreateChat(ctx context.Context, req *CreateChatRequest) (*CreatedChat, error)
+	GetContacts(ctx context.Context) ([]*NetworkContact, error)
+	SearchUsers(ctx context.Context, query string) ([]*NetworkUser, error)
+	// GetAttachmentURL returns a new download URL for an attachment, as the URLs in messages expire.
+	GetAttachmentURL(ctx context.Context, req *GetAttachmentURLRequest) (*AttachmentURL, error)
+	// Download fetches media like avatars from a URL returned by the remote API.
+	Download(ctx context.Context, url string) ([]byte, error)
+	// UploadMedia uploads media to the remote and returns its URL.
+	UploadMedia(ctx context.Context, data []byte, mimeType string) (string, error)
+	ChangeMember(ctx context.Context, req *ChangeMemberRequest) error
+	UpdateChat(ctx context.Context, req *UpdateChatRequest) error
+	// SetPresence sets the online status of the user. It returns ErrPresenceUnsupported if the remote doesn't support it.
+	SetPresence(ctx context.Context, req *SetPresenceRequest) error
+	// Logout revokes the access token of the login and signs out its device on the remote.
+	Logout(ctx context.Context, req *LogoutRequest) error
+}
+
+// SendMessageRequest is the body of a message send request to the remote network.
+type SendMessageRequest struct {
+	ChatID networkid.PortalID `json:"chat_id"`
+	Text   string             `json:"text"`
+	// TransactionID is echoed back by the remote in the resulting NetworkMessage,
+	// which is how the echo is matched to the pending Matrix message.
+	TransactionID networkid.TransactionID `json:"txn_id"`
+}
+
+// GetHistoryRequest asks the remote network for messages in a chat, newest first.
+type GetHistoryRequest struct {
+	ChatID networkid.PortalID
+	// BeforeID is the remote ID of the oldest message already known. If empty, the newest messages are returned.
+	BeforeID string
+	Limit    int
+}
+
+// GetHistoryResponse is a page of history from the remote network.
+type GetHistoryResponse struct {
+	Messages []*NetworkMessage `json:"messages"`
+	HasMore  bool              `json:"has_more"`
+}
+
+// CreateChatRequest asks the remote network to create a chat. The current user is added automatically.
+// For DMs, the remote returns the existing chat if there already is one with the user.
+type CreateChatRequest struct {
+	Type  ChatType `json:"type"`
+	Name  string   `json:"name,omitempty"`
+	Topic string   `json:"topic,omitempty"`
+	// AvatarURL is a URL returned by UploadMedia.
+	AvatarURL string             `json:"avatar_url,omitempty"`
+	Members   []networkid.UserID `json:"members"`
+}
+
+// CreatedChat is the remote's response to a CreateChatRequest.
+type CreatedChat struct {
+	NetworkChat
+	// FailedMembers contains the requested members that couldn't be added, e.g. because their privacy
+	// settings don't allow it. The chat is created without them.
+	FailedMembers []FailedChatMember `json:"failed_members,omitempty"`
+}
+
+// FailedChatMember is a user that couldn't be added to a new chat.
+type FailedChatMember struct {
+	UserID networkid.UserID `json:"user_id"`
+	Reason string           `json:"reason"`
+}
+
+// ChangeMemberRequest asks the remote network to change the membership of a user in a chat.
+// For MemberActionLeave, UserID is the current user.
+type ChangeMemberRequest struct {
+	ChatID networkid.PortalID `json:"-"`
+	UserID networkid.UserID   `json:"user_id"`
+	Action MemberAction       `json:"action"`
+	// Role is the new role of the user for MemberActionSetRole.
+	Role   RemoteRole `json:"role,omitempty"`
+	Reason string     `json:"reason,omitempty"`
+}
+
+// UpdateChatRequest asks the remote network to change the info of a chat. Fields that are nil are left unchanged.
+type UpdateChatRequest struct {
+	ChatID networkid.PortalID `json:"-"`
+	Name   *string            `json:"name,omitempty"`
+	Topic  *string            `json:"topic,omitempty"`
+	// AvatarURL is a URL returned by UploadMedia, or an empty string to remove the avatar.
+	AvatarURL *string `json:"avatar_url,omitempty"`
+	// DisappearTimer is the new disappearing message timer, or zero to turn it off.
+	DisappearTimer *jsontime.Seconds `json:"disappear_timer,omitempty"`
+}
+
+// GetEventsRequest asks the remote network for the changes since the cursor of a previous response.
+// An empty cursor starts the feed at the current state without returning old events.
+type GetEventsRequest struct {
+	Since string
+}
+
+// GetEventsResponse is a page of the remote event feed.
+type GetEventsResponse struct {
+	Events []*NetworkEvent `json:"events"`
+	// Next is the cursor to continue from. It's the same as the request cursor if there were no new events.
+	Next string `json:"next"`
+	// HasMore is set if more events are available right away.
+	HasMore bool `json:"has_more,omitempty"`
+}
+
+// GetAttachmentURLRequest asks the remote network for a new download URL of an attachment.
+type GetAttachmentURLRequest struct {
+	ChatID       networkid.PortalID
+	MessageID    string
+	AttachmentID string
+}
+
+// AttachmentURL is a download URL of an attachment. URLs returned by the remote can be fetched without
+// authentication until they expire, and support HTTP range requests.
+type AttachmentURL struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+// SetPresenceRequest is the body of a request to set the online status of the user.
+type SetPresenceRequest struct {
+	Status PresenceStatus `json:"status"`
+}
+
+// ErrPresenceUnsupported is returned by SetPresence if the remote network doesn't support setting the online status.
+var ErrPresenceUnsupported = errors.New("remote network doesn't support setting presence")
+
+// LogoutRequest asks the remote network to end a session.
+type LogoutRequest struct {
+	DeviceID string `json:"device_id,omitempty"`
+}
+
+// defaultRetryAfter is used when the remote asks us to back off without saying for how long.
+const defaultRetryAfter = 5 * time.Second
+
+// RemoteError is returned when the remote API responds with a non-2xx status.
+type RemoteError struct {
+	StatusCode int
+	Message    string
+	// RetryAfter is how long the remote asked us to wait before trying again.
+	// It's only set for responses that are worth retrying, like HTTP 429 and 503.
+	RetryAfter time.Duration
+}
+
+func (re *RemoteError) Error() string {
+	if re.Message == "" {
+		return fmt.Sprintf("remote API returned HTTP %d", re.StatusCode)
+	}
+	return fmt.Sprintf("remote API returned HTTP %d: %s", re.StatusCode, re.Message)
+}
+
+// isRetriableError returns true if a failed remote call may succeed when tried again later.
+func isRetriableError(err error) bool {
+	var remoteErr *RemoteError
+	if errors.As(err, &remoteErr) {
+		return remoteErr.StatusCode >= 500 || remoteErr.StatusCode == 429 || remoteErr.StatusCode == 408
+	}
+	// Anything that isn't an HTTP error response is a network problem.
+	return true
+}
+
+func isNotFoundError(err error) bool {
+	var remoteErr *RemoteError
+	return errors.As(err, &remoteErr) && remoteErr.StatusCode == http.StatusNotFound
+}
+
+func (c *MyConnector) newRemoteAPI(nc *MyNetworkClient) remoteAPI {
+	var api remoteAPI
+	if c.Config.IsSimulated() {
+		api = &simulatedRemoteAPI{client: nc}
+	} else {
+		api = &httpRemoteAPI{
+			baseURL: strings.TrimSuffix(c.Config.APIBaseURL, "/"),
+			login:   nc.login,
+			http:    &http.Client{Timeout: c.Config.RequestTimeout},
+		}
+	}
+	return &rateLimitedRemoteAPI{api: api, limiter: nc.limiter}
+}
+
+// httpRemoteAPI talks to the remote network's JSON HTTP API.
+type httpRemoteAPI struct {
+	baseURL string
+	login   *bridgev2.UserLogin
+	http    *http.Client
+}
+
+func (h *httpRemoteAPI) do(ctx context.Context, method, path string, reqBody, respBody any) error {
+	var body io.Reader
+	if reqBody != nil {
+		data, err := json.Marshal(reqBody)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, h.baseURL+path, body)
+	if err != nil {
+		return fmt.Errorf("failed to prepare request: %w", err)
+	}
+	if reqBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token := h.login.Metadata.(*LoginMetadata).AccessToken; token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := h.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var errBody struct {
+			Message string `json:"message"`
+		}
+		_ = json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&errBody)
+		remoteErr := &RemoteError{StatusCode: resp.StatusCode, Message: errBody.Message}
+		if retryafter.Should(resp.StatusCode, true) {
+			remoteErr.RetryAfter = max(retryafter.Parse(resp.Header.Get("Retry-After"), defaultRetryAfter), 0)
+		}
+		return remoteErr
+	}
+	if respBody != nil {
+		err = json.NewDecoder(resp.Body).Decode(respBody)
+		if err != nil {
+			return fmt.Errorf("failed to parse response: %w", err)
+		}
+	}
+	return nil
+}
+
+func (h *httpRemoteAPI) SendMessage(ctx context.Context, req *SendMessageRequest) (*NetworkMessage, error) {
+	var resp NetworkMessage
+	err := h.do(ctx, http.MethodPost, "/chats/"+url.PathEscape(string(req.ChatID))+"/messages", req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (h *httpRemoteAPI) GetHistory(ctx context.Context, req *GetHistoryRequest) (*GetHistoryResponse, error) {
+	query := url.Values{"limit": {strconv.Itoa(req.Limit)}}
+	if req.BeforeID != "" {
+		query.Set("before", req.BeforeID)
+	}
+	var resp GetHistoryResponse
+	err := h.do(ctx, http.MethodGet, "/chats/"+url.PathEscape(string(req.ChatID))+"/messages?"+query.Encode(), nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (h *httpRemoteAPI) GetEvents(ctx context.Context, req *GetEventsRequest) (*GetEventsResponse, error) {
+	query := url.Values{}
+	if req.Since != "" {
+		query.Set("since", req.Since)
+	}
+	var resp GetEventsResponse
+	err := h.do(ctx, http.MethodGet, "/events?"+query.Encode(), nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (h *httpRemoteAPI) GetChats(ctx context.Context, limit int) ([]*NetworkChat, error) {
+	query := url.Values{}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	var resp struct {
+		Chats []*NetworkChat `json:"chats"`
+	}
+	err := h.do(ctx, http.MethodGet, "/chats?"+query.Encode(), nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Chats, nil
+}
+
+func (h *httpRemoteAPI) GetUser(ctx context.Context, userID networkid.UserID) (*NetworkUser, error) {
+	var resp NetworkUser
+	err := h.do(ctx, http.MethodGet, "/users/"+url.PathEscape(string(userID)), nil, &resp)
+	if isNotFoundError(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (h *httpRemoteAPI) LookupUser(ctx context.Context, req *LookupUserRequest) (*NetworkUser, error) {
+	var resp NetworkUser
+	err := h.do(ctx, http.MethodPost, "/users/lookup", req, &resp)
+	if isNotFoundError(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (h *httpRemoteAPI) GetContacts(ctx context.Context) ([]*NetworkContact, error) {
+	var resp struct {
+		Contacts []*NetworkContact `json:"contacts"`
+	}
+	err := h.do(ctx, http.MethodGet, "/contacts", nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Contacts, nil
+}
+
+func (h *httpRemoteAPI) SearchUsers(ctx context.Context, query string) ([]*NetworkUser, error) {
+	var resp struct {
+		Users []*NetworkUser `json:"users"`
+	}
+	err := h.do(ctx, http.MethodGet, "/users/search?"+url.Values{"q": {query}}.Encode(), nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Users, nil
+}
+
+func (h *httpRemoteAPI) GetAttachmentURL(ctx context.Context, req *GetAttachmentURLRequest) (*AttachmentURL, error) {
+	var resp AttachmentURL
+	path := fmt.Sprintf("/chats/%s/messages/%s/attachments/%s",
+		url.PathEscape(string(req.ChatID)), url.PathEscape(req.MessageID), url.PathEscape(req.AttachmentID))
+	err := h.do(ctx, http.MethodGet, path, nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (h *httpRemoteAPI) Download(ctx context.Context, mediaURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, mediaURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare request: %w", err)
+	}
+	// Only send the token to the remote itself, media may be served from a CDN.
+	if strings.HasPrefix(mediaURL, h.baseURL+"/") {
+		req.Header.Set("Authorization", "Bearer "+h.login.Metadata.(*LoginMetadata).AccessToken)
+	}
+	resp, err := h.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &RemoteError{StatusCode: resp.StatusCode}
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	return data, nil
+}
+
+func (h *httpRemoteAPI) UploadMedia(ctx context.Context, data []byte, mimeType string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.baseURL+"/media", bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to prepare request: %w", err)
+	}
+	req.Header.Set("Content-Type", mimeType)
+	req.Header.Set("Authorization", "Bearer "+h.login.Metadata.(*LoginMetadata).AccessToken)
+	resp, err := h.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", &RemoteError{StatusCode: resp.StatusCode}
+	}
+	var respData struct {
+		URL string `json:"url"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&respData)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse response: %w", err)
+	}
+	return respData.URL, nil
+}
+
+func (h *httpRemoteAPI) CreateChat(ctx context.Context, req *CreateChatRequest) (*CreatedChat, error) {
+	var resp CreatedChat
+	err := h.do(ctx, http.MethodPost, "/chats", req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (h *httpRemoteAPI) ChangeMember(ctx context.Context, req *ChangeMemberRequest) error {
+	return h.do(ctx, http.MethodPost, "/chats/"+url.PathEscape(string(req.ChatID))+"/members", req, nil)
+}
+
+func (h *httpRemoteAPI) UpdateChat(ctx context.Context, req *UpdateChatRequest) error {
+	return h.do(ctx, http.MethodPatch, "/chats/"+url.PathEscape(string(req.ChatID)), req, nil)
+}
+
+func (h *httpRemoteAPI) SetPresence(ctx context.Context, req *SetPresenceRequest) error {
+	err := h.do(ctx, http.MethodPut, "/presence", req, nil)
+	var remoteErr *RemoteError
+	if errors.As(err, &remoteErr) && (remoteErr.StatusCode == http.StatusNotFound || remoteErr.StatusCode == http.StatusNotImplemented) {
+		return ErrPresenceUnsupported
+	}
+	return err
+}
+
+func (h *httpRemoteAPI) Logout(ctx context.Context, req *LogoutRequest) error {
+	return h.do(ctx, http.MethodPost, "/auth/logout", req, nil)
+}
+
+// simulatedRemoteAPI is the built-in stand-in for a real network. Every call succeeds,
+// and events that a real network would push (like message echoes) are queued on the client directly.
+type simulatedRemoteAPI struct {
+	client *MyNetworkClient
+	// media contains uploaded media by URL.
+	media sync.Map
+	// chats contains the chats created with CreateChat by ID.
+	chats sync.Map
+	// disappearTimers contains the disappearing message timers set with UpdateChat by chat ID.
+	disappearTimers sync.Map
+}
+
+// simulatedDirectory contains the users that can be found with contact lists and search on the simulated network.
+var simulatedDirectory = []*NetworkContact{
+	{NetworkUser: NetworkUser{ID: "example-ghost", Name: "Example Ghost", Username: "example-ghost"}, ContactName: "Friendly ghost"},
+	{NetworkUser: NetworkUser{ID: "simplenetwork_ghosty_ghost", Name: "Ghosty Ghost", Username: "ghosty_ghost", IsBot: true}},
+}
+
+func (s *simulatedRemoteAPI) SendMessage(ctx context.Context, req *SendMessageRequest) (*NetworkMessage, error) {
+	var timer jsontime.Seconds
+	if val, ok := s.disappearTimers.Load(req.ChatID); ok {
+		timer = val.(jsontime.Seconds)
+	}
+	msg := &NetworkMessage{
+		ID:             uuid.NewString(),
+		ChatID:         req.ChatID,
+		SenderID:       s.client.remoteUserID(),
+		Text:           req.Text,
+		Timestamp:      time.Now(),
+		TransactionID:  req.TransactionID,
+		DisappearTimer: timer,
+	}
+	// The event stream is asynchronous on real networks too, so deliver the echo and the
+	// ghost's reply in the background rather than from within the Matrix event handler.
+	go func() {
+		ctx := s.client.log.WithContext(context.Background())
+		s.client.QueueRemoteMessage(ctx, msg)
+		s.client.HandleRemotePresence(ctx, &NetworkPresence{UserID: "example-ghost", Status: PresenceOnline, LastSeen: time.Now()})
+		s.client.QueueRemoteMessage(ctx, &NetworkMessage{
+			ID:             uuid.NewString(),
+			ChatID:         req.ChatID,
+			SenderID:       networkid.UserID("example-ghost"),
+			Text:           "Hi there too",
+			Timestamp:      time.Now(),
+			DisappearTimer: timer,
+		})
+	}()
+	return msg, nil
+}
+
+func (s *simulatedRemoteAPI) GetHistory(ctx context.Context, req *GetHistoryRequest) (*GetHistoryResponse, error) {
+	if req.BeforeID != "" {
+		return &GetHistoryResponse{}, nil
+	}
+	// Placeholder history. The remote IDs are stable, so fetching the same history again
+	// produces the same message IDs and is deduplicated by the bridge.
+	now := time.Now().UTC()
+	history := make([]*NetworkMessage, min(3, req.Limit))
+	for i := range history {
+		history[i] = &NetworkMessage{
+			ID:        fmt.Sprintf("history-%d", len(history)-i),
+			ChatID:    req.ChatID,
+			SenderID:  networkid.UserID("example-ghost"),
+			Text:      fmt.Sprintf("Backfilled history (placeholder) #%d.", len(history)-i),
+			Timestamp: now.Add(-time.Duration(i+1) * time.Minute),
+		}
+	}
+	return &GetHistoryResponse{Messages: history}, nil
+}
+
+// GetEvents never returns anything, as the simulated network delivers its events to the client directly.
+func (s *simulatedRemoteAPI) GetEvents(ctx context.Context, req *GetEventsRequest) (*GetEventsResponse, error) {
+	return &GetEventsResponse{Next: req.Since}, nil
+}
+
+// GetChats returns the chats created in this session, as the simulated network doesn't store anything.
+func (s *simulatedRemoteAPI) GetChats(ctx context.Context, limit int) ([]*NetworkChat, error) {
+	var chats []*NetworkChat
+	s.chats.Range(func(key, value any) bool {
+		chats = append(chats, value.(*NetworkChat))
+		return limit <= 0 || len(chats) < limit
+	})
+	return chats, nil
+}
+
+// GetUser returns nil, as the simulated network has no profiles beyond what's cached in the ghost metadata.
+func (s *simulatedRemoteAPI) GetUser(ctx context.Context, userID networkid.UserID) (*NetworkUser, error) {
+	return nil, nil
+}
+
+// LookupUser finds every identifier, as all users exist on the simulated network.
+func (s *simulatedRemoteAPI) LookupUser(ctx context.Context, req *LookupUserRequest) (*NetworkUser, error) {
+	switch {
+	case req.Phone != "":
+		return &NetworkUser{ID: networkid.UserID("phone-" + req.Phone), Username: "phone-" + req.Phone, Phone: "+" + req.Phone}, nil
+	case req.Email != "":
+		localpart, _, _ := strings.Cut(req.Email, "@")
+		username := strings.Map(func(r rune) rune {
+			if strings.ContainsRune("abcdefghijklmnopqrstuvwxyz0123456789._-", r) {
+				return r
+			}
+			return '_'
+		}, localpart)
+		return &NetworkUser{ID: networkid.UserID(username), Username: username}, nil
+	default:
+		return &NetworkUser{ID: networkid.UserID(req.Username), Username: req.Username}, nil
+	}
+}
+
+// CreateChat creates a chat with everyone except users whose ID starts with "private",
+// which simulates privacy settings that don't allow adding the user to groups.
+func (s *simulatedRemoteAPI) CreateChat(ctx context.Context, req *CreateChatRequest) (*CreatedChat, error) {
+	me := s.client.remoteUserID()
+	chat := &CreatedChat{NetworkChat: NetworkChat{
+		Type:      req.Type,
+		Name:      req.Name,
+		Topic:     req.Topic,
+		AvatarURL: req.AvatarURL,
+		Members:   []NetworkChatMember{{UserID: me, Role: RoleOwner}},
+	}}
+	for _, member := range req.Members {
+		if member == me {
+			continue
+		} else if req.Type != ChatTypeDM && strings.HasPrefix(string(member), "private") {
+			chat.FailedMembers = append(chat.FailedMembers, FailedChatMember{
+				UserID: member,
+				Reason: "The user's privacy settings don't allow adding them to groups",
+			})
+			continue
+		}
+		chat.Members = append(chat.Members, NetworkChatMember{UserID: member, Role: RoleMember})
+	}
+	if req.Type == ChatTypeDM {
+		if len(chat.Members) != 2 {
+			return nil, &RemoteError{StatusCode: http.StatusBadRequest, Message: "DMs must have exactly one other member"}
+		}
+		// DMs are identified by their members, so creating the same DM again returns the existing chat.
+		pair := []string{string(me), string(chat.Members[1].UserID)}
+		slices.Sort(pair)
+		chat.ID = networkid.PortalID("dm:" + pair[0] + ":" + pair[1])
+		chat.Members[0].Role = RoleMember
+	} else {
+		chat.ID = networkid.PortalID(string(req.Type) + ":" + uuid.NewString())
+	}
+	s.chats.Store(chat.ID, &chat.NetworkChat)
+	return chat, nil
+}
+
+func (s *simulatedRemoteAPI) GetContacts(ctx context.Context) ([]*NetworkContact, error) {
+	return simulatedDirectory, nil
+}
+
+func (s *simulatedRemoteAPI) SearchUsers(ctx context.Context, query string) ([]*NetworkUser, error) {
+	query = strings.ToLower(query)
+	var results []*NetworkUser
+	for _, contact := range simulatedDirectory {
+		if strings.Contains(strings.ToLower(contact.Username), query) || strings.Contains(strings.ToLower(contact.Name), query) {
+			results = append(results, &contact.NetworkUser)
+		}
+	}
+	return results, nil
+}
+
+// GetAttachmentURL always fails, as messages on the simulated network don't have attachments.
+func (s *simulatedRemoteAPI) GetAttachmentURL(ctx context.Context, req *GetAttachmentURLRequest) (*AttachmentURL, error) {
+	return nil, &RemoteError{StatusCode: http.StatusNotFound, Message: "attachment not found"}
+}
+
+func (s *simulatedRemoteAPI) Download(ctx context.Context, url string) ([]byte, error) {
+	data, ok := s.media.Load(url)
+	if !ok {
+		return nil, &RemoteError{StatusCode: http.StatusNotFound, Message: "media not found"}
+	}
+	return data.([]byte), nil
+}
+
+func (s *simulatedRemoteAPI) UploadMedia(ctx context.Context, data []byte, mimeType string) (string, error) {
+	url := "simulated://media/" + uuid.NewString()
+	s.media.Store(url, data)
+	return url, nil
+}
+
+// ChangeMember accepts every change except adding users whose ID starts with "private", like CreateChat.
+// The change is echoed back on the event stream like it would be on a real network.
+func (s *simulatedRemoteAPI) ChangeMember(ctx context.Context, req *ChangeMemberRequest) error {
+	if req.Action == MemberActionAdd && strings.HasPrefix(string(req.UserID), "private") {
+		return &RemoteError{StatusCode: http.StatusForbidden, Message: "The user's privacy settings don't allow adding them to groups"}
+	}
+	change := &NetworkMemberChange{
+		ChatID:    req.ChatID,
+		UserID:    req.UserID,
+		SenderID:  s.client.remoteUserID(),
+		Action:    req.Action,
+		Role:      req.Role,
+		Reason:    req.Reason,
+		Timestamp: time.Now(),
+	}
+	go s.client.QueueRemoteMemberChange(s.client.log.WithContext(context.Background()), change)
+	return nil
+}
+
+// UpdateChat accepts every change and echoes it back on the event stream.
+// The disappearing message timer is applied to later messages in the chat.
+func (s *simulatedRemoteAPI) UpdateChat(ctx context.Context, req *UpdateChatRequest) error {
+	if req.DisappearTimer != nil {
+		s.disappearTimers.Store(req.ChatID, *req.DisappearTimer)
+	}
+	update := &NetworkChatUpdate{
+		ChatID:         req.ChatID,
+		SenderID:       s.client.remoteUserID(),
+		Name:           req.Name,
+		Topic:          req.Topic,
+		AvatarURL:      req.AvatarURL,
+		DisappearTimer: req.DisappearTimer,
+		Timestamp:      time.Now(),
+	}
+	go s.client.QueueRemoteChatUpdate(s.client.log.WithContext(context.Background()), update)
+	return nil
+}
+
+// SetPresence accepts every status. The simulated network has no other users who could see it.
+func (s *simulatedRemoteAPI) SetPresence(ctx context.Context, req *SetPresenceRequest) error {
+	return nil
+}
+
+// Logout always succeeds, as the simulated network has no sessions.
+func (s *simulatedRemoteAPI) Logout(ctx context.Context, req *LogoutRequest) error {
+	return nil
+}
@@ -0,0 +1,180 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+	"maunium.net/go/mautrix/bridgev2/status"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+)
+
+// The system portal is the welcome room created during onboarding. Messages sent there aren't bridged to the
+// remote network. Instead, the welcome bot treats them as commands and answers them in the same room.
+
+// systemCommand is a command that the welcome bot answers in the system portal.
+type systemCommand struct {
+	names       []string
+	description string
+	// run returns the reply. Commands that take a while should return right away and queue their result
+	// with queueSystemReply when they're done.
+	run func(nc *MyNetworkClient, ctx context.Context) string
+}
+
+// systemCommands contains the commands other than help, which lists them.
+var systemCommands = []systemCommand{
+	{names: []string{"status"}, description: "Show the connection status of your login", run: (*MyNetworkClient).systemStatus},
+	{names: []string{"sync now", "sync"}, description: "Sync your recent chats from the remote network", run: (*MyNetworkClient).systemSync},
+	{names: []string{"list chats", "chats"}, description: "List your bridged chats", run: (*MyNetworkClient).systemListChats},
+}
+
+// isSystemPortal returns true if the portal is the system portal of this login.
+func (nc *MyNetworkClient) isSystemPortal(portal *bridgev2.Portal) bool {
+	return portal.PortalKey == nc.systemPortalKey()
+}
+
+// handleSystemCommand answers a message sent to the system portal. The message itself is only saved in the database.
+func (nc *MyNetworkClient) handleSystemCommand(ctx context.Context, msg *bridgev2.MatrixMessage) (*bridgev2.MatrixMessageResponse, error) {
+	nc.queueSystemReply(ctx, msg.Portal.PortalKey, nc.runSystemCommand(ctx, msg.Content.Body))
+	return &bridgev2.MatrixMessageResponse{
+		DB: &database.Message{
+			ID:       MakeMessageID(msg.Portal.ID, string(msg.Event.ID)),
+			SenderID: nc.remoteUserID(),
+		},
+	}, nil
+}
+
+// runSystemCommand runs the command in the given message body and returns the reply.
+func (nc *MyNetworkClient) runSystemCommand(ctx context.Context, body string) string {
+	input := strings.ToLower(strings.Join(strings.Fields(body), " "))
+	if input == "help" {
+		return systemHelp()
+	}
+	for _, cmd := range systemCommands {
+		for _, name := range cmd.names {
+			if input == name {
+				return cmd.run(nc, ctx)
+			}
+		}
+	}
+	return fmt.Sprintf("Unknown command %s. Send `help` to see the available commands.", format.SafeMarkdownCode(input))
+}
+
+// queueSystemReply sends a Markdown reply from the welcome bot into the system portal. It goes through the
+// remote event queue like messages from the remote network, so replies stay in order with everything else in the portal.
+func (nc *MyNetworkClient) queueSystemReply(ctx context.Context, portalKey networkid.PortalKey, text string) {
+	nc.queueRemoteEvent(ctx, &simplevent.Message[string]{
+		EventMeta: simplevent.EventMeta{
+			Type:      bridgev2.RemoteEventMessage,
+			PortalKey: portalKey,
+			Sender:    bridgev2.EventSender{Sender: welcomeBotID},
+			Timestamp: time.Now(),
+		},
+		Data:               text,
+		ID:                 MakeMessageID(portalKey.ID, "system-"+uuid.NewString()),
+		ConvertMessageFunc: convertSystemReply,
+	})
+}
+
+func convertSystemReply(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, text string) (*bridgev2.ConvertedMessage, error) {
+	content := format.RenderMarkdown(text, true, false)
+	content.MsgType = event.MsgNotice
+	return &bridgev2.ConvertedMessage{
+		Parts: []*bridgev2.ConvertedMessagePart{{
+			ID:      MakePartID(0),
+			Type:    event.EventMessage,
+			Content: &content,
+		}},
+	}, nil
+}
+
+func systemHelp() string {
+	var buf strings.Builder
+	buf.WriteString("Send one of these commands in this room:\n\n* `help` - Show this list of commands\n")
+	for _, cmd := range systemCommands {
+		_, _ = fmt.Fprintf(&buf, "* `%s` - %s\n", cmd.names[0], cmd.description)
+	}
+	return buf.String()
+}
+
+func (nc *MyNetworkClient) systemStatus(ctx context.Context) string {
+	remote := "the simulated network"
+	if !nc.connector.Config.IsSimulated() {
+		remote = nc.connector.Config.APIBaseURL
+	}
+	state := nc.login.BridgeState.GetPrev().StateEvent
+	if state == "" {
+		state = status.StateUnconfigured
+	}
+	lastSync := "never"
+	nc.withMetadata(func(meta *LoginMetadata) {
+		if meta.LastSyncAt != nil {
+			lastSync = meta.LastSyncAt.UTC().Format(time.RFC1123)
+		}
+	})
+	dropped := nc.dedup.Metrics()
+	return fmt.Sprintf(
+		"Logged in as **%s** on %s.\n\n* Connection: %s\n* Messages waiting to be sent: %d\n* Last chat sync: %s\n"+
+			"* Duplicate events dropped: %d (%d messages, %d edits, %d reactions, %d read receipts)",
+		format.EscapeMarkdown(nc.login.RemoteName), format.EscapeMarkdown(remote), state, nc.outbox.Len(), lastSync,
+		dropped.Total(), dropped.Messages, dropped.Edits, dropped.Reactions, dropped.Receipts,
+	)
+}
+
+// systemSync starts a chat sync in the background, so that the portal event queue isn't blocked while the
+// chat list is fetched. The result is sent as a separate reply.
+func (nc *MyNetworkClient) systemSync(ctx context.Context) string {
+	if !nc.manualSyncRunning.CompareAndSwap(false, true) {
+		return "A sync is already running."
+	}
+	go func() {
+		defer nc.manualSyncRunning.Store(false)
+		ctx := nc.log.With().Str("action", "manual sync").Logger().WithContext(context.Background())
+		count, err := nc.syncChats(ctx)
+		reply := fmt.Sprintf("Synced %d chats.", count)
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to sync chats")
+			reply = fmt.Sprintf("Failed to sync chats: %s", format.EscapeMarkdown(err.Error()))
+		}
+		nc.queueSystemReply(ctx, nc.systemPortalKey(), reply)
+	}()
+	return "Syncing your chats, this may take a moment."
+}
+
+func (nc *MyNetworkClient) systemListChats(ctx context.Context) string {
+	userPortals, err := nc.bridge.DB.UserPortal.GetAllForLogin(ctx, nc.login.UserLogin)
+	if err != nil {
+		return fmt.Sprintf("Failed to get chats: %s", format.EscapeMarkdown(err.Error()))
+	}
+	var buf strings.Builder
+	for _, userPortal := range userPortals {
+		portal, err := nc.bridge.GetExistingPortalByKey(ctx, userPortal.Portal)
+		if err != nil {
+			return fmt.Sprintf("Failed to get chats: %s", format.EscapeMarkdown(err.Error()))
+		} else if portal == nil || portal.MXID == "" || nc.isSystemPortal(portal) {
+			continue
+		}
+		name := portal.Name
+		if name == "" {
+			name = string(portal.ID)
+		}
+		_, _ = fmt.Fprintf(&buf, "* %s\n", format.MarkdownMentionRoomID(name, portal.MXID))
+	}
+	if buf.Len() == 0 {
+		return "You don't have any bridged chats yet."
+	}
+	return "Your bridged chats:\n\n" + buf.String()
+}
+
+// systemPortalKey returns the key of the system portal of this login.
+func (nc *MyNetworkClient) systemPortalKey() networkid.PortalKey {
+	return networkid.PortalKey{ID: MakeWelcomePortalID(nc.login.ID), Receiver: nc.login.ID}
+}
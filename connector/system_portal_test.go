@@ -0,0 +1,35 @@
+package connector
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestRunSystemCommandUnknown(t *testing.T) {
+	tests := []struct {
+		body  string
+		reply string
+	}{
+		{"foo", "Unknown command `foo`."},
+		{"  Foo   BAR ", "Unknown command `foo bar`."},
+		{"`rm` *all*", "Unknown command `` `rm` *all* ``."},
+		{"[link](https://example.org)", "Unknown command `[link](https://example.org)`."},
+	}
+	nc := &MyNetworkClient{}
+	for _, test := range tests {
+		reply := nc.runSystemCommand(context.Background(), test.body)
+		if !strings.HasPrefix(reply, test.reply) {
+			t.Errorf("reply to %q is %q, expected it to start with %q", test.body, reply, test.reply)
+		}
+	}
+}
+
+func TestRunSystemCommandHelp(t *testing.T) {
+	reply := (&MyNetworkClient{}).runSystemCommand(context.Background(), " HELP ")
+	for _, cmd := range systemCommands {
+		if !strings.Contains(reply, "`"+cmd.names[0]+"`") {
+			t.Errorf("help doesn't list %q: %q", cmd.names[0], reply)
+		}
+	}
+}
@@ -1,9 +1,13 @@
 package connector
 
 import (
+	"strings"
 	"time"
 
+	"go.mau.fi/util/jsontime"
+	"maunium.net/go/mautrix/bridgev2/database"
 	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -16,6 +20,49 @@ type LoginMetadata struct {
 	DeviceID     string     `json:"device_id,omitempty"`
 	Scopes       []string   `json:"scopes,omitempty"`
 	LastSyncAt   *time.Time `json:"last_sync_at,omitempty"`
+	// EventCursor is where polling the remote event feed continues. It's empty before the first poll.
+	EventCursor string `json:"event_cursor,omitempty"`
+
+	// ContactNames contains the names the user has saved for their remote contacts.
+	ContactNames map[networkid.UserID]string `json:"contact_names,omitempty"`
+
+	// OnboardedAt is set once the welcome room has been created and all welcome messages have been sent.
+	OnboardedAt *time.Time `json:"onboarded_at,omitempty"`
+	// WelcomeRoomCreatedAt and WelcomeMessagesSent record the steps of an unfinished onboarding,
+	// so that retrying it doesn't post the same messages again.
+	WelcomeRoomCreatedAt *time.Time `json:"welcome_room_created_at,omitempty"`
+	WelcomeMessagesSent  []string   `json:"welcome_messages_sent,omitempty"`
+
+	// Outbox contains messages from Matrix that haven't been sent to the remote network yet.
+	Outbox []*OutboxEntry `json:"outbox,omitempty"`
+}
+
+// clearCredentials removes the session data of the remote network, so that nothing in the database can be used
+// to access the remote account anymore.
+func (m *LoginMetadata) clearCredentials() {
+	m.AccessToken = ""
+	m.ExpiresAt = time.Time{}
+	m.DeviceID = ""
+	m.Scopes = nil
+}
+
+// Ensure LoginMetadata implements MetaMerger.
+var _ database.MetaMerger = (*LoginMetadata)(nil)
+
+// CopyFrom implements database.MetaMerger. It's called when logging in again to an existing login and only
+// replaces the session, so the state of the login (like the outbox and the onboarding status) is kept.
+func (m *LoginMetadata) CopyFrom(other any) {
+	newMeta, ok := other.(*LoginMetadata)
+	if !ok {
+		return
+	}
+	if newMeta.RemoteUserID != "" {
+		m.RemoteUserID = newMeta.RemoteUserID
+	}
+	m.AccessToken = newMeta.AccessToken
+	m.ExpiresAt = newMeta.ExpiresAt
+	m.DeviceID = newMeta.DeviceID
+	m.Scopes = newMeta.Scopes
 }
 
 // New creates a new instance for database registration.
@@ -24,20 +71,139 @@ func (m *LoginMetadata) New() any {
 }
 
 // GhostMetadata stores additional remote metadata for a Matrix ghost.
+// The profile fields are the inputs of the displayname template, so the name can be re-rendered without
+// fetching the profile again.
 type GhostMetadata struct {
 	RemoteUserID string `json:"remote_user_id,omitempty"`
 	RemoteName   string `json:"remote_name,omitempty"`
+	Username     string `json:"username,omitempty"`
+	Phone        string `json:"phone,omitempty"`
+	IsBot        bool   `json:"is_bot,omitempty"`
 	AvatarURL    string `json:"avatar_url,omitempty"`
 }
 
+// DisplaynameParams returns the template parameters for the stored remote profile.
+func (m *GhostMetadata) DisplaynameParams() DisplaynameParams {
+	return DisplaynameParams{
+		Name:     m.RemoteName,
+		Username: m.Username,
+		Phone:    m.Phone,
+		IsBot:    m.IsBot,
+	}
+}
+
 // New creates a new instance for database registration.
 func (m *GhostMetadata) New() any {
 	return &GhostMetadata{}
 }
 
+// ChatType is the kind of remote chat a portal is for.
+type ChatType string
+
+const (
+	ChatTypeDM    ChatType = "dm"
+	ChatTypeGroup ChatType = "group"
+	// ChatTypeChannel is a broadcast channel where only admins can post.
+	ChatTypeChannel ChatType = "channel"
+	// ChatTypeAnnouncement is a read-only chat, like service notifications from the network itself.
+	ChatTypeAnnouncement ChatType = "announcement"
+)
+
+// CanSend returns true if a user with the given role may post in a chat of this type.
+func (ct ChatType) CanSend(role RemoteRole) bool {
+	switch {
+	case ct == ChatTypeAnnouncement, role == RoleRestricted:
+		return false
+	case ct == ChatTypeChannel:
+		return role.AtLeast(RoleAdmin)
+	default:
+		return true
+	}
+}
+
+// CanInvite returns true if a user with the given role may add members to a chat of this type.
+func (ct ChatType) CanInvite(role RemoteRole) bool {
+	switch ct {
+	case ChatTypeGroup:
+		return role.AtLeast(RoleMember)
+	case ChatTypeChannel:
+		return role.AtLeast(RoleAdmin)
+	default:
+		return false
+	}
+}
+
+// CanManageMembers returns true if a user with the given role may remove and ban members in a chat of this type.
+func (ct ChatType) CanManageMembers(role RemoteRole) bool {
+	switch ct {
+	case ChatTypeGroup, ChatTypeChannel:
+		return role.AtLeast(RoleModerator)
+	default:
+		return false
+	}
+}
+
+// CanEditInfo returns true if a user with the given role may change the name, topic and avatar of a chat of this type.
+// DMs don't have their own info, they use the other user's profile.
+func (ct ChatType) CanEditInfo(role RemoteRole) bool {
+	switch ct {
+	case ChatTypeGroup:
+		return role.AtLeast(RoleMember)
+	case ChatTypeChannel:
+		return role.AtLeast(RoleAdmin)
+	default:
+		return false
+	}
+}
+
+// CanChangeRole returns true if a user with the given role may change another member's role from one role to another.
+// Admins and owners can only promote and demote users below themselves, to roles below their own.
+func (ct ChatType) CanChangeRole(role, from, to RemoteRole) bool {
+	switch ct {
+	case ChatTypeGroup, ChatTypeChannel:
+		return role.AtLeast(RoleAdmin) && role.rank() > from.rank() && role.rank() > to.rank()
+	default:
+		return false
+	}
+}
+
+// RemoteRole is the role of a user in a remote chat.
+type RemoteRole string
+
+const (
+	RoleOwner     RemoteRole = "owner"
+	RoleAdmin     RemoteRole = "admin"
+	RoleModerator RemoteRole = "moderator"
+	RoleMember    RemoteRole = "member"
+	// RoleRestricted can read the chat, but not post in it.
+	RoleRestricted RemoteRole = "restricted"
+)
+
+func (r RemoteRole) rank() int {
+	switch r {
+	case RoleOwner:
+		return 4
+	case RoleAdmin:
+		return 3
+	case RoleModerator:
+		return 2
+	case RoleRestricted:
+		return 0
+	default:
+		// Unknown roles are treated like members.
+		return 1
+	}
+}
+
+// AtLeast returns true if the role is the same as or higher than the other role.
+func (r RemoteRole) AtLeast(other RemoteRole) bool {
+	return r.rank() >= other.rank()
+}
+
 // PortalMetadata stores additional remote metadata for a Matrix portal (room).
 type PortalMetadata struct {
 	RemoteRoomID  string              `json:"remote_room_id,omitempty"`
+	ChatType      ChatType            `json:"chat_type,omitempty"`
 	OtherUserID   networkid.UserID    `json:"other_user_id,omitempty"`
 	InitialName   string              `json:"initial_name,omitempty"`
 	InitialAvatar id.ContentURIString `json:"initial_avatar_mxc,omitempty"`
@@ -47,9 +213,269 @@ type PortalMetadata struct {
 	LastMessageID string              `json:"last_message_id,omitempty"`
 	Tags          []string            `json:"tags,omitempty"`
 	Notes         map[string]string   `json:"notes,omitempty"`
+	// Roles contains the users whose role in the chat isn't RoleMember.
+	Roles map[networkid.UserID]RemoteRole `json:"roles,omitempty"`
+}
+
+// GetChatType returns the chat type. Portals created before the type was stored
+// are DMs if they have another user and groups otherwise.
+func (m *PortalMetadata) GetChatType() ChatType {
+	if m.ChatType != "" {
+		return m.ChatType
+	} else if m.OtherUserID != "" {
+		return ChatTypeDM
+	}
+	return ChatTypeGroup
+}
+
+// RoleOf returns the role of the given user in the chat.
+func (m *PortalMetadata) RoleOf(userID networkid.UserID) RemoteRole {
+	if role, ok := m.Roles[NormalizeRemoteUserID(string(userID))]; ok {
+		return role
+	}
+	// User IDs are case-insensitive. Roles are stored normalized, but older portals have them as the remote sent them.
+	for otherID, role := range m.Roles {
+		if strings.EqualFold(string(otherID), string(userID)) {
+			return role
+		}
+	}
+	return RoleMember
 }
 
 // New creates a new instance for database registration.
 func (m *PortalMetadata) New() any {
 	return &PortalMetadata{}
 }
+
+// NetworkMessage is a message as delivered by the remote network.
+type NetworkMessage struct {
+	// ID is the remote network's own identifier for the message. It's only unique within the chat.
+	ID        string             `json:"id"`
+	ChatID    networkid.PortalID `json:"chat_id"`
+	SenderID  networkid.UserID   `json:"sender_id"`
+	Text      string             `json:"text"`
+	Timestamp time.Time          `json:"timestamp"`
+	// EditedAt is set when the message is delivered again because it was edited.
+	EditedAt time.Time `json:"edited_at,omitempty"`
+	// TransactionID is set on the echo of a message that was sent through the bridge.
+	TransactionID networkid.TransactionID `json:"txn_id,omitempty"`
+	// Attachments are the files of the message. The text, if any, is their caption.
+	Attachments []*NetworkAttachment `json:"attachments,omitempty"`
+	// DisappearTimer is set if the message is deleted on the remote that long after it was sent.
+	DisappearTimer jsontime.Seconds `json:"disappear_timer"`
+}
+
+// NetworkAttachment is a file attached to a remote message.
+type NetworkAttachment struct {
+	// ID is the remote network's identifier for the attachment. It's only unique within the message.
+	ID string `json:"id"`
+	// URL is a download URL that's valid until URLExpiresAt, or forever if that's zero.
+	// A new one can be requested with GetAttachmentURL.
+	URL          string    `json:"url"`
+	URLExpiresAt time.Time `json:"url_expires_at,omitempty"`
+	MimeType     string    `json:"mime_type"`
+	FileName     string    `json:"file_name"`
+	Size         int64     `json:"size,omitempty"`
+	Width        int       `json:"width,omitempty"`
+	Height       int       `json:"height,omitempty"`
+}
+
+// NetworkUser is a user profile as returned by the remote network.
+type NetworkUser struct {
+	ID       networkid.UserID `json:"id"`
+	Name     string           `json:"name"`
+	Username string           `json:"username"`
+	Phone    string           `json:"phone,omitempty"`
+	IsBot    bool             `json:"is_bot,omitempty"`
+	// AvatarURL is downloaded through the remote API, so it may require authentication.
+	AvatarURL string `json:"avatar_url,omitempty"`
+}
+
+// NetworkContact is an entry in the user's remote contact list.
+type NetworkContact struct {
+	NetworkUser
+	// ContactName is the name the user has saved for the contact, if any.
+	ContactName string `json:"contact_name,omitempty"`
+}
+
+// ghostMetadata returns the profile of the user as stored in the ghost metadata.
+func (nu *NetworkUser) ghostMetadata() GhostMetadata {
+	return GhostMetadata{
+		RemoteUserID: string(nu.ID),
+		RemoteName:   nu.Name,
+		Username:     nu.Username,
+		Phone:        nu.Phone,
+		IsBot:        nu.IsBot,
+		AvatarURL:    nu.AvatarURL,
+	}
+}
+
+// NetworkChat is a chat as returned by the remote network.
+type NetworkChat struct {
+	ID    networkid.PortalID `json:"id"`
+	Type  ChatType           `json:"type"`
+	Name  string             `json:"name,omitempty"`
+	Topic string             `json:"topic,omitempty"`
+	// AvatarURL is downloaded through the remote API, like user avatars.
+	AvatarURL string              `json:"avatar_url,omitempty"`
+	Members   []NetworkChatMember `json:"members"`
+	// DisappearTimer is the disappearing message timer of new messages in the chat, zero if it's off.
+	DisappearTimer jsontime.Seconds `json:"disappear_timer"`
+}
+
+// NetworkChatMember is a member of a remote chat.
+type NetworkChatMember struct {
+	UserID networkid.UserID `json:"user_id"`
+	Role   RemoteRole       `json:"role,omitempty"`
+}
+
+// MemberAction is a change to the membership of a remote chat. The remote network has no pending
+// invites: adding a user makes them a member right away.
+type MemberAction string
+
+const (
+	MemberActionAdd    MemberAction = "add"
+	MemberActionRemove MemberAction = "remove"
+	MemberActionBan    MemberAction = "ban"
+	MemberActionUnban  MemberAction = "unban"
+	MemberActionLeave  MemberAction = "leave"
+	// MemberActionJoin is only delivered by the remote, e.g. when a user joins through an invite link.
+	MemberActionJoin MemberAction = "join"
+	// MemberActionSetRole changes the role of a member without changing their membership.
+	MemberActionSetRole MemberAction = "set_role"
+)
+
+// Membership returns the Matrix membership of the target user after the action.
+func (ma MemberAction) Membership() event.Membership {
+	switch ma {
+	case MemberActionAdd, MemberActionJoin, MemberActionSetRole:
+		return event.MembershipJoin
+	case MemberActionBan:
+		return event.MembershipBan
+	default:
+		return event.MembershipLeave
+	}
+}
+
+// NetworkMemberChange is a membership change as delivered by the remote network.
+type NetworkMemberChange struct {
+	ChatID networkid.PortalID `json:"chat_id"`
+	UserID networkid.UserID   `json:"user_id"`
+	// SenderID is the user who made the change. It's the same as UserID for joins and leaves.
+	SenderID networkid.UserID `json:"sender_id"`
+	Action   MemberAction     `json:"action"`
+	// Role is the new role of the user for MemberActionSetRole.
+	Role      RemoteRole `json:"role,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	Timestamp time.Time  `json:"timestamp"`
+}
+
+// NetworkChatUpdate is a change to the info of a chat as delivered by the remote network.
+// Fields that didn't change are nil.
+type NetworkChatUpdate struct {
+	ChatID    networkid.PortalID `json:"chat_id"`
+	SenderID  networkid.UserID   `json:"sender_id"`
+	Name      *string            `json:"name,omitempty"`
+	Topic     *string            `json:"topic,omitempty"`
+	AvatarURL *string            `json:"avatar_url,omitempty"`
+	// DisappearTimer is set when the disappearing message timer changed, zero if it was turned off.
+	DisappearTimer *jsontime.Seconds `json:"disappear_timer,omitempty"`
+	Timestamp      time.Time         `json:"timestamp"`
+}
+
+// disappearingSetting returns the bridge setting for a remote disappearing message timer.
+// Remote timers always start when the message is sent.
+func disappearingSetting(timer jsontime.Seconds) database.DisappearingSetting {
+	if timer.Duration <= 0 {
+		return database.DisappearingSetting{}
+	}
+	return database.DisappearingSetting{
+		Type:  event.DisappearingTypeAfterSend,
+		Timer: timer.Duration,
+	}
+}
+
+// PresenceStatus is the online status of a user on the remote network.
+type PresenceStatus string
+
+const (
+	PresenceOnline  PresenceStatus = "online"
+	PresenceAway    PresenceStatus = "away"
+	PresenceOffline PresenceStatus = "offline"
+)
+
+// MatrixPresence returns the Matrix presence state that corresponds to the remote status.
+func (ps PresenceStatus) MatrixPresence() event.Presence {
+	switch ps {
+	case PresenceOnline:
+		return event.PresenceOnline
+	case PresenceAway:
+		return event.PresenceUnavailable
+	default:
+		return event.PresenceOffline
+	}
+}
+
+// PresenceStatusFromMatrix returns the remote status that corresponds to a Matrix presence state.
+func PresenceStatusFromMatrix(presence event.Presence) PresenceStatus {
+	switch presence {
+	case event.PresenceOnline:
+		return PresenceOnline
+	case event.PresenceUnavailable:
+		return PresenceAway
+	default:
+		return PresenceOffline
+	}
+}
+
+// NetworkPresence is the online status of a remote user as delivered by the remote network.
+type NetworkPresence struct {
+	UserID networkid.UserID `json:"user_id"`
+	Status PresenceStatus   `json:"status"`
+	// LastSeen is when the user was last online. It's zero if the user hides it.
+	LastSeen time.Time `json:"last_seen,omitempty"`
+}
+
+// NetworkReaction is a reaction as delivered by the remote network.
+type NetworkReaction struct {
+	ChatID    networkid.PortalID `json:"chat_id"`
+	MessageID string             `json:"message_id"`
+	SenderID  networkid.UserID   `json:"sender_id"`
+	Emoji     string             `json:"emoji"`
+	Timestamp time.Time          `json:"timestamp"`
+	// Removed is set when the sender took the reaction back.
+	Removed bool `json:"removed,omitempty"`
+}
+
+// NetworkReadReceipt is a read receipt as delivered by the remote network.
+// It marks every message up to and including MessageID as read.
+type NetworkReadReceipt struct {
+	ChatID    networkid.PortalID `json:"chat_id"`
+	MessageID string             `json:"message_id"`
+	SenderID  networkid.UserID   `json:"sender_id"`
+	Timestamp time.Time          `json:"timestamp"`
+}
+
+// NetworkEventType is the kind of change in a NetworkEvent.
+type NetworkEventType string
+
+const (
+	NetworkEventMessage      NetworkEventType = "message"
+	NetworkEventReaction     NetworkEventType = "reaction"
+	NetworkEventReadReceipt  NetworkEventType = "read_receipt"
+	NetworkEventMemberChange NetworkEventType = "member_change"
+	NetworkEventChatUpdate   NetworkEventType = "chat_update"
+	NetworkEventPresence     NetworkEventType = "presence"
+)
+
+// NetworkEvent is a change on the remote network as returned by its event feed.
+// Only the field matching Type is set. Edited messages are messages with EditedAt set.
+type NetworkEvent struct {
+	Type         NetworkEventType     `json:"type"`
+	Message      *NetworkMessage      `json:"message,omitempty"`
+	Reaction     *NetworkReaction     `json:"reaction,omitempty"`
+	ReadReceipt  *NetworkReadReceipt  `json:"read_receipt,omitempty"`
+	MemberChange *NetworkMemberChange `json:"member_change,omitempty"`
+	ChatUpdate   *NetworkChatUpdate   `json:"chat_update,omitempty"`
+	Presence     *NetworkPresence     `json:"presence,omitempty"`
+}